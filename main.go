@@ -4,11 +4,18 @@ import (
 	"github.com/breathbath/certmanager/pkg/cmd"
 	"github.com/breathbath/certmanager/pkg/errs"
 	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/pkg/errors"
+	"os"
+	"time"
 )
 
 func main() {
 	logging.Init()
 
 	err := cmd.Execute()
+	logging.Shutdown(10 * time.Second)
+	if errors.Is(err, cmd.ErrInvalidConfig) {
+		os.Exit(1)
+	}
 	errs.Handle(err, true)
 }
@@ -0,0 +1,33 @@
+package backup
+
+import (
+	"github.com/kelseyhightower/envconfig"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+type Config struct {
+	BackupPath string `envconfig:"BACKUP_PATH"`
+	// BackupKeyPath points to a file with a base64 encoded 256 bit AES key, usually mounted from a secret,
+	// backups are written unencrypted if it's empty
+	BackupKeyPath string `envconfig:"BACKUP_KEY_PATH"`
+	// BackupKeep is the number of backups kept per secret, 0 keeps all of them
+	BackupKeep int `envconfig:"BACKUP_KEEP" default:"10"`
+	// BackupMaxAge removes backups older than the given duration, 0 disables it
+	BackupMaxAge time.Duration `envconfig:"BACKUP_MAX_AGE" default:"0"`
+	// BackupHistory archives every issued certificate and the one it replaces
+	BackupHistory bool `envconfig:"BACKUP_HISTORY" default:"false"`
+}
+
+func LoadConfig() (cfg *Config, err error) {
+	cfg = new(Config)
+	err = envconfig.Process("certmanager", cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load backup config")
+	}
+
+	logrus.Infof("loaded backup config: %+v", cfg)
+
+	return cfg, nil
+}
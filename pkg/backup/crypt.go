@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// encryptedHeader prefixes every encrypted backup file, it's followed by the GCM nonce and the sealed data
+var encryptedHeader = []byte("CERTMANAGER-BACKUP-AES256GCM\n")
+
+func loadKey(keyPath string) ([]byte, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read backup key file %s", keyPath)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "backup key in %s is not base64 encoded", keyPath)
+	}
+
+	if len(key) != 32 {
+		return nil, errors.Errorf("backup key in %s must be 32 bytes long, got %d", keyPath, len(key))
+	}
+
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create AES cipher")
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func encrypt(key, plain []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce")
+	}
+
+	out := append([]byte{}, encryptedHeader...)
+	out = append(out, nonce...)
+
+	return gcm.Seal(out, nonce, plain, encryptedHeader), nil
+}
+
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedHeader)
+}
+
+func decrypt(key, data []byte) ([]byte, error) {
+	if key == nil {
+		return nil, errors.New("backup is encrypted but no backup key is configured")
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data = data[len(encryptedHeader):]
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted backup is truncated")
+	}
+
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], encryptedHeader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt backup, the key might be wrong")
+	}
+
+	return plain, nil
+}
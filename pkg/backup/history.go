@@ -0,0 +1,130 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	historyDir = "history"
+
+	annotationPrefix          = "certmanager.breathbath.github.io/"
+	AnnotationSerial          = annotationPrefix + "serial"
+	AnnotationFingerprint     = annotationPrefix + "fingerprint-sha256"
+	AnnotationNotAfter        = annotationPrefix + "not-after"
+	AnnotationCertURL         = annotationPrefix + "cert-url"
+	AnnotationArchivedAt      = annotationPrefix + "archived-at"
+	AnnotationArchivedBecause = annotationPrefix + "archived-because"
+
+	ArchiveReasonIssued   = "issued"
+	ArchiveReasonReplaced = "replaced"
+)
+
+// Version is a metadata of a certificate archived in the history of a secret
+type Version struct {
+	Serial      string
+	Fingerprint string
+	NotAfter    time.Time
+	CertURL     string
+}
+
+func NewVersion(cert *x509.Certificate, certURL string) Version {
+	sum := sha256.Sum256(cert.Raw)
+
+	return Version{
+		Serial:      fmt.Sprintf("%X", cert.SerialNumber),
+		Fingerprint: hex.EncodeToString(sum[:]),
+		NotAfter:    cert.NotAfter.UTC(),
+		CertURL:     certURL,
+	}
+}
+
+// VersionOf reads the history metadata from the backup annotations
+func VersionOf(b *Backup) Version {
+	if b.Secret == nil {
+		return Version{}
+	}
+
+	v := Version{
+		Serial:      b.Secret.Annotations[AnnotationSerial],
+		Fingerprint: b.Secret.Annotations[AnnotationFingerprint],
+		CertURL:     b.Secret.Annotations[AnnotationCertURL],
+	}
+	v.NotAfter, _ = time.Parse(time.RFC3339, b.Secret.Annotations[AnnotationNotAfter])
+
+	return v
+}
+
+func (s *Store) HistoryEnabled() bool {
+	return s.history
+}
+
+// Archive adds the certificate to the version history of the secret, certificates which are already archived are skipped
+func (s *Store) Archive(namespace, secretName string, certPEM, keyPEM []byte, certURL, reason string) (string, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return "", errors.Errorf("no PEM certificate to archive for secret %s/%s", namespace, secretName)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse certificate to archive for secret %s/%s", namespace, secretName)
+	}
+
+	version := NewVersion(cert, certURL)
+	dir := s.historyPath(namespace, secretName)
+
+	// the certificate issue time is used in the file name, so versions are ordered as they were issued
+	fileName := fmt.Sprintf("%s_%s", version.Serial, cert.NotBefore.UTC().Format(timestampFormat))
+	for _, ext := range []string{plainExt, encryptedExt} {
+		if _, err := os.Stat(filepath.Join(dir, fileName+ext)); err == nil {
+			logrus.Debugf("certificate %s of secret %s/%s is already archived", version.Serial, namespace, secretName)
+			return filepath.Join(dir, fileName+ext), nil
+		}
+	}
+
+	annotations := map[string]string{
+		AnnotationSerial:          version.Serial,
+		AnnotationFingerprint:     version.Fingerprint,
+		AnnotationNotAfter:        version.NotAfter.Format(time.RFC3339),
+		AnnotationArchivedAt:      time.Now().UTC().Format(time.RFC3339),
+		AnnotationArchivedBecause: reason,
+	}
+	if certURL != "" {
+		annotations[AnnotationCertURL] = certURL
+	}
+
+	archivePath, err := s.writeSecret(dir, fileName, namespace, secretName, certPEM, keyPEM, annotations)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.pruneDir(dir, time.Now()); err != nil {
+		logrus.WithError(err).Warn("failed to prune certificate history")
+	}
+
+	return archivePath, nil
+}
+
+// History returns archived versions of the secret sorted from the newest to the oldest one
+func (s *Store) History(namespace, secretName string) ([]*Backup, error) {
+	dir := s.historyPath(namespace, secretName)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return []*Backup{}, nil
+	}
+
+	return s.listDir(dir)
+}
+
+func (s *Store) historyPath(namespace, secretName string) string {
+	return filepath.Join(s.path, historyDir, strings.Join([]string{sanitizeName(namespace), sanitizeName(secretName)}, "_"))
+}
@@ -0,0 +1,363 @@
+package backup
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	timestampFormat = "20060102T150405Z"
+	plainExt        = ".yaml"
+	encryptedExt    = ".yaml.enc"
+)
+
+// Backup is a TLS secret manifest stored in the backup path
+type Backup struct {
+	Path      string
+	CreatedAt time.Time
+	Secret    *v1.Secret
+	Cert      *x509.Certificate
+	// Err is set if the backup file cannot be read or parsed
+	Err error
+}
+
+func (b *Backup) Namespace() string {
+	if b.Secret == nil {
+		return ""
+	}
+	return b.Secret.Namespace
+}
+
+func (b *Backup) SecretName() string {
+	if b.Secret == nil {
+		return ""
+	}
+	return b.Secret.Name
+}
+
+// Verify checks that the backup contains a certificate which is not expired and matches the private key
+func (b *Backup) Verify(now time.Time) error {
+	if b.Err != nil {
+		return b.Err
+	}
+
+	if _, err := tls.X509KeyPair(b.Secret.Data[v1.TLSCertKey], b.Secret.Data[v1.TLSPrivateKeyKey]); err != nil {
+		return errors.Wrapf(err, "backup %s contains an invalid key pair", b.Path)
+	}
+
+	if now.Before(b.Cert.NotBefore) {
+		return errors.Errorf("certificate in backup %s is not valid before %s", b.Path, b.Cert.NotBefore.UTC().Format(time.RFC3339))
+	}
+
+	if !b.Cert.NotAfter.After(now) {
+		return errors.Errorf("certificate in backup %s expired at %s", b.Path, b.Cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+type Store struct {
+	path    string
+	key     []byte
+	keep    int
+	maxAge  time.Duration
+	history bool
+}
+
+func NewStore(cfg *Config) (*Store, error) {
+	s := &Store{
+		path:    cfg.BackupPath,
+		keep:    cfg.BackupKeep,
+		maxAge:  cfg.BackupMaxAge,
+		history: cfg.BackupHistory,
+	}
+
+	if strings.TrimSpace(cfg.BackupKeyPath) != "" {
+		key, err := loadKey(cfg.BackupKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		s.key = key
+	}
+
+	return s, nil
+}
+
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Write stores the certificate data as a TLS secret manifest and returns the path of the created file
+func (s *Store) Write(namespace, secretName, domain string, certPEM, keyPEM []byte) (string, error) {
+	safeNamespace := sanitizeName(namespace)
+	safeSecret := sanitizeName(secretName)
+	safeDomain := sanitizeName(domain)
+	timestamp := time.Now().UTC().Format(timestampFormat)
+
+	fileName := fmt.Sprintf("%s_%s_%s_%s", safeNamespace, safeSecret, safeDomain, timestamp)
+	secretPath, err := s.writeSecret(s.path, fileName, namespace, secretName, certPEM, keyPEM, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.Prune(time.Now()); err != nil {
+		logrus.WithError(err).Warn("failed to prune backups")
+	}
+
+	return secretPath, nil
+}
+
+func (s *Store) writeSecret(
+	dir, fileName, namespace, secretName string,
+	certPEM, keyPEM []byte,
+	annotations map[string]string,
+) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Wrapf(err, "failed to create backup path %s", dir)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", errors.Wrapf(err, "backup path %s is not accessible", dir)
+	}
+	if !info.IsDir() {
+		return "", errors.Errorf("backup path %s is not a directory", dir)
+	}
+
+	secretYAML, err := buildTLSSecretYAML(namespace, secretName, certPEM, keyPEM, annotations)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to build secret manifest")
+	}
+
+	ext := plainExt
+	data := []byte(secretYAML)
+	if s.key != nil {
+		ext = encryptedExt
+		data, err = encrypt(s.key, data)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to encrypt secret backup")
+		}
+	}
+
+	secretPath := filepath.Join(dir, fileName+ext)
+	if err := os.WriteFile(secretPath, data, 0600); err != nil {
+		return "", errors.Wrapf(err, "failed to write secret backup %s", secretPath)
+	}
+
+	return secretPath, nil
+}
+
+// Prune removes backups older than the max age and the oldest ones exceeding the number of backups kept per secret
+func (s *Store) Prune(now time.Time) error {
+	return s.pruneDir(s.path, now)
+}
+
+func (s *Store) pruneDir(dir string, now time.Time) error {
+	if s.keep <= 0 && s.maxAge <= 0 {
+		return nil
+	}
+
+	backups, err := s.listDir(dir)
+	if err != nil {
+		return err
+	}
+
+	keptPerSecret := map[string]int{}
+	for _, b := range backups {
+		expired := s.maxAge > 0 && now.Sub(b.CreatedAt) > s.maxAge
+
+		exceeded := false
+		if b.Err == nil && s.keep > 0 {
+			secretKey := b.Namespace() + "/" + b.SecretName()
+			keptPerSecret[secretKey]++
+			exceeded = keptPerSecret[secretKey] > s.keep
+		}
+
+		if !expired && !exceeded {
+			continue
+		}
+
+		if err := os.Remove(b.Path); err != nil {
+			return errors.Wrapf(err, "failed to remove backup %s", b.Path)
+		}
+		logrus.Infof("pruned backup %s", b.Path)
+	}
+
+	return nil
+}
+
+// List returns all backups sorted from the newest to the oldest one,
+// files which cannot be parsed are returned with the Err field set
+func (s *Store) List() ([]*Backup, error) {
+	return s.listDir(s.path)
+}
+
+func (s *Store) listDir(dir string) ([]*Backup, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read backup path %s", dir)
+	}
+
+	backups := []*Backup{}
+	for _, entry := range entries {
+		if entry.IsDir() || !isBackupFile(entry.Name()) {
+			continue
+		}
+
+		backups = append(backups, s.Load(filepath.Join(dir, entry.Name())))
+	}
+
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
+	})
+
+	return backups, nil
+}
+
+// Find returns backups of the given secret sorted from the newest to the oldest one
+func (s *Store) Find(namespace, secretName string) ([]*Backup, error) {
+	all, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	found := []*Backup{}
+	for _, b := range all {
+		if b.Err == nil && b.Namespace() == namespace && b.SecretName() == secretName {
+			found = append(found, b)
+		}
+	}
+
+	return found, nil
+}
+
+// Load reads a single backup file
+func (s *Store) Load(filePath string) *Backup {
+	b := &Backup{Path: filePath}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		b.Err = errors.Wrapf(err, "failed to stat backup %s", filePath)
+		return b
+	}
+	b.CreatedAt = parseTimestamp(filePath, info.ModTime())
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		b.Err = errors.Wrapf(err, "failed to read backup %s", filePath)
+		return b
+	}
+
+	if isEncrypted(data) {
+		data, err = decrypt(s.key, data)
+		if err != nil {
+			b.Err = errors.Wrapf(err, "failed to read backup %s", filePath)
+			return b
+		}
+	}
+
+	secret := &v1.Secret{}
+	if err := yaml.Unmarshal(data, secret); err != nil {
+		b.Err = errors.Wrapf(err, "failed to parse backup %s", filePath)
+		return b
+	}
+	if secret.Namespace == "" || secret.Name == "" {
+		b.Err = errors.Errorf("backup %s has no secret namespace or name", filePath)
+		return b
+	}
+	b.Secret = secret
+
+	block, _ := pem.Decode(secret.Data[v1.TLSCertKey])
+	if block == nil {
+		b.Err = errors.Errorf("backup %s contains no PEM certificate", filePath)
+		return b
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		b.Err = errors.Wrapf(err, "failed to parse certificate from backup %s", filePath)
+		return b
+	}
+	b.Cert = cert
+
+	return b
+}
+
+func isBackupFile(name string) bool {
+	return strings.HasSuffix(name, plainExt) || strings.HasSuffix(name, encryptedExt)
+}
+
+// parseTimestamp reads the creation time from the last part of the backup file name
+func parseTimestamp(filePath string, fallback time.Time) time.Time {
+	name := filepath.Base(filePath)
+	name = strings.TrimSuffix(strings.TrimSuffix(name, encryptedExt), plainExt)
+	idx := strings.LastIndex(name, "_")
+	if idx < 0 {
+		return fallback
+	}
+
+	ts, err := time.Parse(timestampFormat, name[idx+1:])
+	if err != nil {
+		return fallback
+	}
+
+	return ts
+}
+
+func buildTLSSecretYAML(namespace, secretName string, certPEM, keyPEM []byte, annotations map[string]string) (string, error) {
+	secret := &v1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secretName,
+			Namespace:   namespace,
+			Annotations: annotations,
+		},
+		Type: v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			"tls.crt": certPEM,
+			"tls.key": keyPEM,
+		},
+	}
+
+	out, err := yaml.Marshal(secret)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal secret yaml")
+	}
+
+	return string(out), nil
+}
+
+func sanitizeName(value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "unknown"
+	}
+
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r
+		case r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, value)
+}
@@ -0,0 +1,126 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+// keys of the account secret
+const (
+	accountKeyKey       = "key"
+	accountURIKey       = "uri"
+	accountDirectoryKey = "directory"
+)
+
+// accountSecret is the secret keeping the ACME account of the issuer, empty if every order registers a new account
+func (c *ACMEConfig) accountSecret() string {
+	if c == nil {
+		return ""
+	}
+	if c.AccountSecret != "" {
+		return strings.TrimSpace(c.AccountSecret)
+	}
+	if c.EABSecret != "" {
+		return strings.TrimSpace(c.EABSecret) + "-account"
+	}
+
+	return ""
+}
+
+// loadAccount returns the ACME user with the account from the account secret of the issuer,
+// the user has a new key and no registration if no account is kept for the directory yet
+func (cm *CertManager) loadAccount(ctx context.Context, acmeCfg *ACMEConfig, email string) (*User, error) {
+	user := &User{Email: email}
+
+	if ref := acmeCfg.accountSecret(); ref != "" {
+		namespace, name, err := ParseSecretRef(ref)
+		if err != nil {
+			return nil, err
+		}
+		kubeSecrets, err := cm.kubernetes()
+		if err != nil {
+			return nil, err
+		}
+
+		getCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		secret, err := kubeSecrets.GetSecret(getCtx, namespace, name)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+
+		directory := cm.directoryURL(acmeCfg)
+		switch {
+		case secret == nil:
+			logging.FromContext(ctx).Infof("Account secret %s doesn't exist, registering a new ACME account", ref)
+		case string(secret.Data[accountDirectoryKey]) != directory:
+			logging.FromContext(ctx).Warnf(
+				"Account secret %s holds an account of %s, registering a new ACME account at %s",
+				ref,
+				secret.Data[accountDirectoryKey],
+				directory,
+			)
+		default:
+			key, err := certcrypto.ParsePEMPrivateKey(secret.Data[accountKeyKey])
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to parse the account key from secret %s", ref)
+			}
+			uri := strings.TrimSpace(string(secret.Data[accountURIKey]))
+			if uri == "" {
+				return nil, errors.Errorf("account secret %s has no %s key", ref, accountURIKey)
+			}
+
+			logging.FromContext(ctx).Debugf("Using ACME account %s from secret %s", uri, ref)
+			user.Key = key
+			user.Registration = &registration.Resource{URI: uri}
+
+			return user, nil
+		}
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate private key")
+	}
+	user.Key = key
+
+	return user, nil
+}
+
+// saveAccount keeps the registered account in the account secret of the issuer, so the following orders reuse it
+func (cm *CertManager) saveAccount(ctx context.Context, acmeCfg *ACMEConfig, user *User) error {
+	ref := acmeCfg.accountSecret()
+	if ref == "" {
+		return nil
+	}
+
+	namespace, name, err := ParseSecretRef(ref)
+	if err != nil {
+		return err
+	}
+	kubeSecrets, err := cm.kubernetes()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err = kubeSecrets.SaveSecretData(ctx, namespace, name, map[string][]byte{
+		accountKeyKey:       certcrypto.PEMEncode(user.Key),
+		accountURIKey:       []byte(user.Registration.URI),
+		accountDirectoryKey: []byte(cm.directoryURL(acmeCfg)),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to save ACME account to secret %s", ref)
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"github.com/breathbath/certmanager/pkg/k8s"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/acme/api"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/pkg/errors"
+	"math/big"
+	"time"
+)
+
+const (
+	ariAnnotationPrefix      = "certmanager.breathbath.github.io/ari-"
+	AnnotationARIWindowStart = ariAnnotationPrefix + "window-start"
+	AnnotationARIWindowEnd   = ariAnnotationPrefix + "window-end"
+	AnnotationARIRenewAt     = ariAnnotationPrefix + "renew-at"
+	AnnotationARINextCheck   = ariAnnotationPrefix + "next-check"
+	// AnnotationARICertID binds the stored schedule to the certificate it was fetched for
+	AnnotationARICertID  = ariAnnotationPrefix + "cert-id"
+	defaultARIRetryAfter = 6 * time.Hour
+	acmeUnauthorizedErr  = "urn:ietf:params:acme:error:unauthorized"
+)
+
+// ariDecision is the ARI based renewal decision for the certificate currently stored in the task secret
+type ariDecision struct {
+	// RenewNow is set when the current time is inside the renewal window suggested by the CA
+	RenewNow bool
+	// Scheduled is set when the CA gave a renewal window, the fixed renewal window doesn't apply then
+	Scheduled bool
+	// ReplacesCertID identifies the current certificate in the replaces field of the new order
+	ReplacesCertID string
+}
+
+// checkRenewalInfo checks the ACME renewal information of the stored certificate, the suggested window
+// and the chosen renewal time are kept in the secret annotations until the CA asks to check again,
+// tasks writing files have no place for the schedule and use the fixed renewal window
+func (cm *CertManager) checkRenewalInfo(ctx context.Context, task CertTask) ariDecision {
+	plan := ariDecision{}
+	if !cm.cfg.ARIEnabled || task.Files != nil || !task.isACME() {
+		return plan
+	}
+
+	log := logging.FromContext(ctx)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	secret, err := cm.kubeSecretManager.GetSecret(ctx, task.Namespace, task.Secret)
+	if err != nil || secret == nil {
+		return plan
+	}
+
+	cert, err := k8s.ParseCertificate(secret)
+	if err != nil {
+		return plan
+	}
+
+	certID, err := certificate.MakeARICertID(cert)
+	if err != nil {
+		return plan
+	}
+
+	now := time.Now().UTC()
+	renewAt, nextCheck := parseTime(secret.Annotations[AnnotationARIRenewAt]), parseTime(secret.Annotations[AnnotationARINextCheck])
+	if secret.Annotations[AnnotationARICertID] == certID && !renewAt.IsZero() && now.Before(nextCheck) {
+		plan.ReplacesCertID = certID
+		plan.Scheduled = true
+		plan.RenewNow = !now.Before(renewAt)
+		return plan
+	}
+
+	info, err := cm.fetchRenewalInfo(task, cert)
+	if errors.Is(err, api.ErrNoARI) {
+		log.Debugf("ACME directory %s doesn't support renewal information", cm.directoryURL(task.ACME))
+		return plan
+	}
+	if err != nil {
+		log.Warnf("Failed to get renewal information for secret %s/%s, falling back to the fixed renewal window: %v", task.Namespace, task.Secret, err)
+		return plan
+	}
+
+	plan.ReplacesCertID = certID
+
+	renewAt = pickRenewalTime(info.SuggestedWindow.Start, info.SuggestedWindow.End)
+	retryAfter := info.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = defaultARIRetryAfter
+	}
+
+	log.Infof(
+		"CA suggests renewing secret %s/%s between %s and %s, renewal is scheduled at %s",
+		task.Namespace,
+		task.Secret,
+		info.SuggestedWindow.Start.UTC().Format(time.RFC3339),
+		info.SuggestedWindow.End.UTC().Format(time.RFC3339),
+		renewAt.Format(time.RFC3339),
+	)
+
+	err = cm.kubeSecretManager.PatchAnnotations(ctx, task.Namespace, task.Secret, map[string]string{
+		AnnotationARIWindowStart: info.SuggestedWindow.Start.UTC().Format(time.RFC3339),
+		AnnotationARIWindowEnd:   info.SuggestedWindow.End.UTC().Format(time.RFC3339),
+		AnnotationARIRenewAt:     renewAt.Format(time.RFC3339),
+		AnnotationARINextCheck:   now.Add(retryAfter).Format(time.RFC3339),
+		AnnotationARICertID:      certID,
+	})
+	if err != nil {
+		log.Warn(err)
+	}
+
+	plan.Scheduled = true
+	plan.RenewNow = !now.Before(renewAt)
+	if plan.RenewNow {
+		log.Infof("Renewal window suggested by the CA is reached for secret %s/%s", task.Namespace, task.Secret)
+	}
+
+	return plan
+}
+
+// replacesRejected tells if the CA refused the new order because of the certificate it replaces,
+// e.g. when the certificate was ordered by another account or was replaced already
+func replacesRejected(err error) bool {
+	switch e := err.(type) {
+	case *acme.AlreadyReplacedError:
+		return true
+	case *acme.ProblemDetails:
+		// only errors of the order request itself come unwrapped, failed challenges are reported per domain
+		return e.Type == acmeUnauthorizedErr
+	}
+
+	return false
+}
+
+// clearRenewalInfo drops the stored schedule of the task secret, so the next check fetches the renewal information again
+func (cm *CertManager) clearRenewalInfo(ctx context.Context, task CertTask) {
+	if task.Files != nil || cm.kubeSecretManager == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := cm.kubeSecretManager.PatchAnnotations(ctx, task.Namespace, task.Secret, map[string]string{
+		AnnotationARIWindowStart: "",
+		AnnotationARIWindowEnd:   "",
+		AnnotationARIRenewAt:     "",
+		AnnotationARINextCheck:   "",
+		AnnotationARICertID:      "",
+	})
+	if err != nil {
+		logging.FromContext(ctx).Warn(err)
+	}
+}
+
+func (cm *CertManager) fetchRenewalInfo(task CertTask, cert *x509.Certificate) (*certificate.RenewalInfoResponse, error) {
+	// renewal information is public, so a throwaway key without an account is enough for the client
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate key for ACME client")
+	}
+
+	client, err := cm.newACMEClient(&User{Key: key}, task.ACME, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create ACME client")
+	}
+
+	return client.Certificate.GetRenewalInfo(certificate.RenewalInfoRequest{Cert: cert})
+}
+
+// pickRenewalTime selects a uniformly random time inside the window as recommended by the ARI specification
+func pickRenewalTime(start, end time.Time) time.Time {
+	start, end = start.UTC(), end.UTC()
+
+	window := end.Sub(start)
+	if window <= 0 {
+		return start
+	}
+
+	offset, err := rand.Int(rand.Reader, big.NewInt(int64(window)))
+	if err != nil {
+		return start
+	}
+
+	return start.Add(time.Duration(offset.Int64())).Truncate(time.Second)
+}
+
+func parseTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return t
+}
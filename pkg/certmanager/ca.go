@@ -0,0 +1,172 @@
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/breathbath/certmanager/pkg/k8s"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/breathbath/certmanager/pkg/sink"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// CAConfig references the CA keypair used by the ca issuer
+type CAConfig struct {
+	// Secret is a secret in namespace/name form with the PEM encoded CA certificate and private key
+	Secret string `json:"Secret"`
+	// CertKey is the key of the CA certificate in Secret, "tls.crt" by default
+	CertKey string `json:"CertKey,omitempty"`
+	// KeyKey is the key of the CA private key in Secret, "tls.key" by default
+	KeyKey string `json:"KeyKey,omitempty"`
+}
+
+func (c *CAConfig) Validate() error {
+	if _, _, err := ParseSecretRef(c.Secret); err != nil {
+		return errors.Wrap(err, "invalid Secret")
+	}
+
+	return nil
+}
+
+// caKeypair is the signing certificate and key of the ca issuer
+type caKeypair struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	// chainPEM is the CA certificate followed by its own issuers as stored in the secret
+	chainPEM []byte
+}
+
+// issueFromCA signs a certificate with the CA keypair from the task CA secret
+func (cm *CertManager) issueFromCA(ctx context.Context, task CertTask) (*sink.Certificate, error) {
+	log := logging.FromContext(ctx)
+
+	ca, err := cm.loadCA(ctx, task.CA)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !now.Before(ca.cert.NotAfter) {
+		return nil, errors.Errorf("CA certificate %s from secret %s expired at %s", ca.cert.Subject, task.CA.Secret, ca.cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	key, err := generateKey(task.KeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := leafTemplate(task, key.Public())
+	if err != nil {
+		return nil, err
+	}
+	if template.NotAfter.After(ca.cert.NotAfter) {
+		// a certificate expiring inside the renewal window would be signed again on every run
+		if renewBefore := cm.renewBefore(task); !ca.cert.NotAfter.After(now.Add(renewBefore)) {
+			return nil, errors.Errorf(
+				"CA certificate %s from secret %s expires at %s within the renewal window %s, the CA must be renewed",
+				ca.cert.Subject,
+				task.CA.Secret,
+				ca.cert.NotAfter.UTC().Format(time.RFC3339),
+				renewBefore,
+			)
+		}
+		log.Warnf("Certificate validity is cut to the CA expiry at %s", ca.cert.NotAfter.UTC().Format(time.RFC3339))
+		template.NotAfter = ca.cert.NotAfter
+	}
+
+	log.Infof("Issuing certificate for %s signed by CA %s valid until %s", task.Domain, ca.cert.Subject, template.NotAfter.UTC().Format(time.RFC3339))
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign certificate with CA")
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	return &sink.Certificate{
+		CertPEM: append(certPEM, ca.chainPEM...),
+		KeyPEM:  certcrypto.PEMEncode(key),
+	}, nil
+}
+
+// loadCA reads the CA keypair from its secret and checks that it can sign certificates
+func (cm *CertManager) loadCA(ctx context.Context, caCfg *CAConfig) (*caKeypair, error) {
+	namespace, name, err := ParseSecretRef(caCfg.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	kubeSecrets, err := cm.kubernetes()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	secret, err := kubeSecrets.GetSecret(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.Errorf("CA secret %s doesn't exist", caCfg.Secret)
+	}
+
+	certKey, keyKey := caCfg.CertKey, caCfg.KeyKey
+	if certKey == "" {
+		certKey = "tls.crt"
+	}
+	if keyKey == "" {
+		keyKey = "tls.key"
+	}
+
+	certs, err := certcrypto.ParsePEMBundle(secret.Data[certKey])
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse CA certificate %s of secret %s", certKey, caCfg.Secret)
+	}
+	cert := certs[0]
+	if !cert.IsCA || (cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageCertSign == 0) {
+		return nil, errors.Errorf("certificate %s in secret %s is not allowed to sign certificates", cert.Subject, caCfg.Secret)
+	}
+
+	privateKey, err := certcrypto.ParsePEMPrivateKey(secret.Data[keyKey])
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse CA private key %s of secret %s", keyKey, caCfg.Secret)
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("unsupported CA private key type in secret %s", caCfg.Secret)
+	}
+
+	publicKey, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(cert.PublicKey) {
+		return nil, errors.Errorf("CA private key in secret %s doesn't match the CA certificate", caCfg.Secret)
+	}
+
+	chainPEM := &bytes.Buffer{}
+	for _, c := range certs {
+		_ = pem.Encode(chainPEM, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+
+	return &caKeypair{cert: cert, key: signer, chainPEM: chainPEM.Bytes()}, nil
+}
+
+// outputs adds ca.crt to the outputs of tasks signed by a private CA, clients need it to trust the certificate
+func outputs(task CertTask) *k8s.OutputConfig {
+	if task.Issuer != IssuerCA {
+		return task.Outputs
+	}
+
+	out := k8s.OutputConfig{}
+	if task.Outputs != nil {
+		out = *task.Outputs
+	}
+	out.CA = true
+
+	return &out
+}
@@ -1,7 +1,10 @@
 package certmanager
 
 import (
-	"encoding/json"
+	"github.com/breathbath/certmanager/pkg/backup"
+	"github.com/breathbath/certmanager/pkg/k8s"
+	"github.com/breathbath/certmanager/pkg/notify"
+	"github.com/breathbath/certmanager/pkg/sink"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -9,21 +12,130 @@ import (
 	"time"
 )
 
+// DefaultRenewBefore is the global renewal window used when CERTMANAGER_RENEW_BEFORE isn't set
+const DefaultRenewBefore = 720 * time.Hour
+
 type CertTask struct {
 	Namespace string `json:"Namespace"`
 	Domain    string `json:"Domain"`
 	Secret    string `json:"Secret"`
 	Email     string `json:"Email"`
+	// Issuer selects how the certificate is issued, "acme" by default
+	Issuer string `json:"Issuer,omitempty"`
+	// KeyType of the certificate private key, "rsa2048" by default
+	KeyType string `json:"KeyType,omitempty"`
+	// DNSNames are added to Domain in certificates of the selfsigned and ca issuers
+	DNSNames    []string `json:"DNSNames,omitempty"`
+	IPAddresses []string `json:"IPAddresses,omitempty"`
+	URIs        []string `json:"URIs,omitempty"`
+	// Validity of certificates of the selfsigned and ca issuers, "2160h" by default
+	Validity *Duration `json:"Validity,omitempty"`
+	// KeyUsages of certificates of the selfsigned and ca issuers like "digital signature" or "client auth",
+	// "digital signature", "key encipherment" for RSA keys and "server auth" by default
+	KeyUsages []string `json:"KeyUsages,omitempty"`
+	// CA is the CA keypair of the ca issuer
+	CA *CAConfig `json:"CA,omitempty"`
+	// Namespaces lists additional namespaces where a copy of the secret is kept
+	Namespaces []string `json:"Namespaces,omitempty"`
+	// NamespaceSelector is a label selector of namespaces where a copy of the secret is kept
+	NamespaceSelector string `json:"NamespaceSelector,omitempty"`
+	// RenewBefore overrides the global renewal window
+	RenewBefore *Duration `json:"RenewBefore,omitempty"`
+	// ACME overrides the ACME directory and configures external account binding
+	ACME *ACMEConfig `json:"ACME,omitempty"`
+	// ACMEIssuer names an entry of ACMEIssuers in the config file, it is used instead of ACME
+	ACMEIssuer string `json:"ACMEIssuer,omitempty"`
+	// Notify adds notification channels for this task only
+	Notify *notify.TaskConfig `json:"Notify,omitempty"`
+	// Outputs adds extra certificate formats to the secret
+	Outputs *k8s.OutputConfig `json:"Outputs,omitempty"`
+	// Rollout lists workloads restarted after the certificate is renewed
+	Rollout *k8s.RolloutConfig `json:"Rollout,omitempty"`
+	// Files writes the certificate to the local filesystem instead of a secret
+	Files *sink.FileConfig `json:"Files,omitempty"`
+}
+
+// renewBefore is the fixed renewal window of the task, the task setting overrides the global one
+func (t CertTask) renewBefore(global time.Duration) time.Duration {
+	if t.RenewBefore != nil {
+		return t.RenewBefore.Duration
+	}
+
+	return global
+}
+
+// Target names where the task stores the certificate
+func (t CertTask) Target() string {
+	if t.Files != nil {
+		return "files " + t.Files.Cert
+	}
+
+	return "secret " + t.Namespace + "/" + t.Secret
+}
+
+// IsReplicated tells if copies of the secret are kept in other namespaces
+func (t CertTask) IsReplicated() bool {
+	return len(t.Namespaces) > 0 || t.NamespaceSelector != ""
+}
+
+// isACME tells if the task orders certificates from an ACME CA
+func (t CertTask) isACME() bool {
+	return t.Issuer == "" || t.Issuer == IssuerACME
+}
+
+// filesPath is the certificate file of tasks writing files, empty for secret tasks
+func (t CertTask) filesPath() string {
+	if t.Files == nil {
+		return ""
+	}
+
+	return t.Files.Cert
 }
 
 type Config struct {
-	RunInterval    time.Duration `envconfig:"RUN_INTERVAL" default:"5m"`
-	InitialDelay   time.Duration `envconfig:"INITIAL_DELAY" default:"1m"`
-	ChallengePath  string        `envconfig:"CHALLENGE_PATH" required:"true"`
-	BackupPath     string        `envconfig:"BACKUP_PATH"`
+	RunInterval  time.Duration `envconfig:"RUN_INTERVAL" default:"5m"`
+	InitialDelay time.Duration `envconfig:"INITIAL_DELAY" default:"1m"`
+	// ChallengePath is the directory shared with the challenge server, it's not needed when both run in one process
+	ChallengePath  string        `envconfig:"CHALLENGE_PATH"`
 	CertIssTimeout time.Duration `envconfig:"ISSUE_TIMEOUT" default:"20m"`
 	ConfigPath     string        `envconfig:"CONFIG_PATH" requited:"true"`
+	ACMEDirectory  string        `envconfig:"ACME_DIRECTORY" default:"https://acme-v02.api.letsencrypt.org/directory"`
+	// DryRun reads secrets and decides on renewals but never writes secrets or orders from the configured CA
+	DryRun bool `envconfig:"DRY_RUN" default:"false"`
+	// DryRunIssue orders certificates from DryRunDirectory in dry run mode instead of only logging the plan
+	DryRunIssue     bool   `envconfig:"DRY_RUN_ISSUE" default:"false"`
+	DryRunDirectory string `envconfig:"DRY_RUN_DIRECTORY" default:"https://acme-staging-v02.api.letsencrypt.org/directory"`
+	// RenewBefore is the remaining certificate validity which triggers renewal when the CA gives no renewal information,
+	// the default is DefaultRenewBefore
+	RenewBefore time.Duration `envconfig:"RENEW_BEFORE" default:"720h"`
+	// ARIEnabled schedules renewals inside the window suggested by the ACME renewal information endpoint
+	ARIEnabled bool `envconfig:"ARI_ENABLED" default:"true"`
+	// RevocationCheck reissues certificates which were revoked according to their OCSP responder or CRL
+	RevocationCheck bool `envconfig:"REVOCATION_CHECK" default:"false"`
+	// SelfCheckEnabled fetches a probe token from the domain before ordering to catch broken challenge routing
+	SelfCheckEnabled bool          `envconfig:"SELF_CHECK_ENABLED" default:"true"`
+	SelfCheckTimeout time.Duration `envconfig:"SELF_CHECK_TIMEOUT" default:"10s"`
+	// ScanEnabled turns on periodic expiry checks of all TLS secrets in ScanNamespaces, all namespaces are scanned if it's empty
+	ScanEnabled    bool          `envconfig:"SCAN_ENABLED" default:"false"`
+	ScanNamespaces []string      `envconfig:"SCAN_NAMESPACES"`
+	ScanInterval   time.Duration `envconfig:"SCAN_INTERVAL" default:"1h"`
+	ScanWarnBefore time.Duration `envconfig:"SCAN_WARN_BEFORE" default:"336h"`
 	CertTasks      []CertTask
+	backup.Config
+}
+
+// needsKubernetes tells if any of the configured features reads or writes cluster resources
+func (c *Config) needsKubernetes() bool {
+	if c.ScanEnabled {
+		return true
+	}
+	for _, task := range c.CertTasks {
+		if task.Files == nil || task.Issuer == IssuerCA || task.ACME.accountSecret() != "" {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (c *Config) loadTasks() error {
@@ -32,32 +144,21 @@ func (c *Config) loadTasks() error {
 		return errors.Wrapf(err, "failed to read config file %s", c.ConfigPath)
 	}
 
-	tasls := []CertTask{}
-	err = json.Unmarshal(file, &tasls)
+	tasks, err := ParseTasks(file, c.RenewBefore)
 	if err != nil {
-		return errors.Wrapf(err, "failed to unmarshal config file %s: %s into ConfigTasks", c.ConfigPath, string(file))
+		return errors.Wrapf(err, "invalid config file %s", c.ConfigPath)
 	}
 
-	for _, task := range tasls {
-		if task.Namespace == "" {
-			return errors.Errorf("namespace is empty in task %+v", task)
-		}
-		if task.Domain == "" {
-			return errors.Errorf("domain is empty in task %+v", task)
-		}
-		if task.Secret == "" {
-			return errors.Errorf("secret is empty in task %+v", task)
-		}
-		if task.Email == "" {
-			return errors.Errorf("Email is empty in task %+v", task)
-		}
-	}
-
-	c.CertTasks = tasls
+	c.CertTasks = tasks
 
 	return nil
 }
 
+// renewBefore is the fixed renewal window of the task, the task setting overrides the global one
+func (c *Config) renewBefore(task CertTask) time.Duration {
+	return task.renewBefore(c.RenewBefore)
+}
+
 func LoadConfig() (cfg *Config, err error) {
 	cfg = new(Config)
 	err = envconfig.Process("certmanager", cfg)
@@ -0,0 +1,36 @@
+package certmanager
+
+import (
+	"context"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/breathbath/certmanager/pkg/sink"
+	"github.com/pkg/errors"
+)
+
+// dryRunIssue runs the HTTP-01 self-check and, if enabled, orders the certificate from the dry run directory,
+// the result is never written to the secret
+func (cm *CertManager) dryRunIssue(ctx context.Context, task CertTask) (*sink.Certificate, error) {
+	log := logging.FromContext(ctx)
+	if !cm.cfg.DryRunIssue {
+		provider, err := cm.newProvider(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := cm.selfCheck(ctx, provider, task.Domain); err != nil {
+			return nil, err
+		}
+
+		return nil, sink.ErrIssueSkipped
+	}
+
+	if cm.cfg.DryRunDirectory == cm.cfg.ACMEDirectory || cm.cfg.DryRunDirectory == cm.directoryURL(task.ACME) {
+		return nil, errors.Errorf("dry run directory %s is the one used for real orders", cm.cfg.DryRunDirectory)
+	}
+
+	log.Infof("dry run: ordering certificate for %s from %s", task.Domain, cm.cfg.DryRunDirectory)
+
+	staging := task
+	staging.ACME = &ACMEConfig{DirectoryURL: cm.cfg.DryRunDirectory}
+
+	return cm.issueACME(ctx, staging, "")
+}
@@ -0,0 +1,31 @@
+package certmanager
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Duration is a time.Duration written as a string like "720h" in the config file
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return errors.Errorf("duration must be a string like \"720h\", got %s", string(data))
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return errors.Wrapf(err, "invalid duration %q", value)
+	}
+	d.Duration = parsed
+
+	return nil
+}
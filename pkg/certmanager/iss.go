@@ -3,51 +3,67 @@ package certmanager
 import (
 	"context"
 	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
 	"fmt"
+	"github.com/breathbath/certmanager/pkg/challenge"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/breathbath/certmanager/pkg/sink"
+	"github.com/breathbath/certmanager/pkg/tracing"
+	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
 	"github.com/go-acme/lego/v4/lego"
 	"github.com/go-acme/lego/v4/registration"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"os"
-	"path"
+	"go.opentelemetry.io/otel/attribute"
+	"strings"
+	"time"
 )
 
 // CustomProvider implements http01.Provider interface
 type CustomProvider struct {
-	cfg          *Config
+	tokens challenge.TokenStore
+	log    *logrus.Entry
+	// ctx is the parent of the challenge spans
+	ctx          context.Context
 	currentToken string
 }
 
-func (p *CustomProvider) Present(_, token, keyAuth string) error {
-	filePath := path.Join(p.cfg.ChallengePath, token)
-	logrus.Infof("Presenting the challenge for token: %s", token)
+func (p *CustomProvider) Present(_, token, keyAuth string) (err error) {
+	_, span := tracing.Start(p.ctx, "challenge.Present", attribute.String("certmanager.token", token))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	p.log.Infof("Presenting the challenge for token: %s", token)
 
-	err := os.WriteFile(filePath, []byte(keyAuth), 0644)
+	err = p.tokens.Put(token, keyAuth)
 	if err != nil {
-		logrus.Errorf("Error writing challenge file for token %s: %v", token, err)
-		return errors.Wrap(err, "Failed to write challenge file")
+		p.log.Errorf("Error storing challenge for token %s: %v", token, err)
+		return err
 	}
 
-	logrus.Debugf("Successfully wrote challenge file for token: %s", token)
+	p.log.Debugf("Successfully stored challenge for token: %s", token)
 	p.currentToken = token
 
 	return nil
 }
 
-func (p *CustomProvider) CleanUp(_, token, _ string) error {
-	logrus.Infof("Cleaning up the challenge for token: %s", token)
+func (p *CustomProvider) CleanUp(_, token, _ string) (err error) {
+	_, span := tracing.Start(p.ctx, "challenge.CleanUp", attribute.String("certmanager.token", token))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	p.log.Infof("Cleaning up the challenge for token: %s", token)
 
-	err := p.delete(token)
+	err = p.delete(token)
 	if err != nil {
-		logrus.Errorf("Error cleaning up challenge file for token %s: %v", token, err)
+		p.log.Errorf("Error cleaning up challenge for token %s: %v", token, err)
 		return err
 	}
 
 	if p.currentToken == token {
-		logrus.Debug("Clearing current token in CustomProvider")
+		p.log.Debug("Clearing current token in CustomProvider")
 		p.currentToken = ""
 	}
 
@@ -55,16 +71,15 @@ func (p *CustomProvider) CleanUp(_, token, _ string) error {
 }
 
 func (p *CustomProvider) delete(token string) error {
-	filePath := path.Join(p.cfg.ChallengePath, token)
-	logrus.Infof("Deleting challenge file: %s", filePath)
+	p.log.Infof("Deleting challenge for token: %s", token)
 
-	err := os.Remove(filePath)
+	err := p.tokens.Delete(token)
 	if err != nil {
-		logrus.Errorf("Error deleting challenge file for token %s: %v", token, err)
-		return errors.Wrap(err, "Failed to remove challenge file")
+		p.log.Errorf("Error deleting challenge for token %s: %v", token, err)
+		return err
 	}
 
-	logrus.Debugf("Successfully deleted challenge file for token: %s", token)
+	p.log.Debugf("Successfully deleted challenge for token: %s", token)
 	return nil
 }
 
@@ -73,10 +88,19 @@ func (p *CustomProvider) Cleanup() error {
 		return nil
 	}
 
-	logrus.Debugf("Performing cleanup for currentToken: %s", p.currentToken)
+	p.log.Debugf("Performing cleanup for currentToken: %s", p.currentToken)
 	return p.delete(p.currentToken)
 }
 
+// newProvider creates a challenge provider storing tokens where the challenge server reads them
+func (cm *CertManager) newProvider(ctx context.Context) (*CustomProvider, error) {
+	if cm.tokens == nil {
+		return nil, errors.New("CERTMANAGER_CHALLENGE_PATH must be set to answer HTTP-01 challenges")
+	}
+
+	return &CustomProvider{tokens: cm.tokens, log: logging.FromContext(ctx), ctx: ctx}, nil
+}
+
 // User implements lego.User interface
 type User struct {
 	Email        string
@@ -99,73 +123,238 @@ func (u *User) GetPrivateKey() crypto.PrivateKey {
 	return u.Key
 }
 
-func (cm *CertManager) Issue(email, domain string) (cert, pk []byte, err error) {
-	logrus.Info("Starting certificate issuance process")
+// ACMEConfig selects the ACME CA of a task and its external account binding
+type ACMEConfig struct {
+	// DirectoryURL overrides the globally configured ACME directory
+	DirectoryURL string `json:"DirectoryURL,omitempty"`
+	// EABSecret is a secret in namespace/name form with the external account binding key ID and HMAC key
+	EABSecret string `json:"EABSecret,omitempty"`
+	// EABKeyIDKey is the key of the key ID in EABSecret, "keyID" by default
+	EABKeyIDKey string `json:"EABKeyIDKey,omitempty"`
+	// EABHMACKey is the key of the base64url encoded HMAC key in EABSecret, "hmacKey" by default
+	EABHMACKey string `json:"EABHMACKey,omitempty"`
+	// AccountSecret is a secret in namespace/name form keeping the ACME account which is registered once and reused,
+	// it is the EABSecret name with the "-account" suffix by default, without both every order registers a new account
+	AccountSecret string `json:"AccountSecret,omitempty"`
+}
+
+func (c *ACMEConfig) Validate() error {
+	if c.EABSecret != "" {
+		if _, _, err := ParseSecretRef(c.EABSecret); err != nil {
+			return errors.Wrap(err, "invalid EABSecret")
+		}
+	}
+	if c.AccountSecret != "" {
+		if _, _, err := ParseSecretRef(c.AccountSecret); err != nil {
+			return errors.Wrap(err, "invalid AccountSecret")
+		}
+	}
+
+	return nil
+}
 
-	userKey, err := rsa.GenerateKey(rand.Reader, 2048)
+func (cm *CertManager) directoryURL(acmeCfg *ACMEConfig) string {
+	if acmeCfg != nil && acmeCfg.DirectoryURL != "" {
+		return acmeCfg.DirectoryURL
+	}
+
+	return cm.cfg.ACMEDirectory
+}
+
+// externalAccountBinding reads the EAB credentials from the secret configured for the task
+func (cm *CertManager) externalAccountBinding(ctx context.Context, acmeCfg *ACMEConfig) (keyID, hmacKey string, err error) {
+	namespace, name, err := ParseSecretRef(acmeCfg.EABSecret)
 	if err != nil {
-		logrus.Errorf("Error generating private key: %v", err)
-		return nil, nil, errors.Wrap(err, "Failed to generate private key")
+		return "", "", err
 	}
-	logrus.Debug("Successfully generated private key")
 
-	user := &User{
-		Email: email,
-		Key:   userKey,
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	secret, err := cm.kubeSecretManager.GetSecret(ctx, namespace, name)
+	if err != nil {
+		return "", "", err
+	}
+	if secret == nil {
+		return "", "", errors.Errorf("EAB secret %s doesn't exist", acmeCfg.EABSecret)
 	}
-	logrus.Infof("Defined ACME user with email: %s", email)
 
-	config := lego.NewConfig(user)
-	config.CADirURL = lego.LEDirectoryProduction
+	keyIDKey, hmacKeyKey := acmeCfg.EABKeyIDKey, acmeCfg.EABHMACKey
+	if keyIDKey == "" {
+		keyIDKey = "keyID"
+	}
+	if hmacKeyKey == "" {
+		hmacKeyKey = "hmacKey"
+	}
+
+	keyID = strings.TrimSpace(string(secret.Data[keyIDKey]))
+	hmacKey = strings.TrimSpace(string(secret.Data[hmacKeyKey]))
+	if keyID == "" || hmacKey == "" {
+		return "", "", errors.Errorf("EAB secret %s must contain %s and %s keys", acmeCfg.EABSecret, keyIDKey, hmacKeyKey)
+	}
+
+	return keyID, hmacKey, nil
+}
+
+func (cm *CertManager) register(ctx context.Context, client *lego.Client, acmeCfg *ACMEConfig) (reg *registration.Resource, err error) {
+	ctx, span := tracing.Start(ctx, "acme.register")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	if acmeCfg == nil || acmeCfg.EABSecret == "" {
+		return client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	}
 
-	client, err := lego.NewClient(config)
+	keyID, hmacKey, err := cm.externalAccountBinding(ctx, acmeCfg)
 	if err != nil {
-		logrus.Errorf("Error creating ACME client: %v", err)
-		return nil, nil, errors.Wrap(err, "Failed to create ACME client")
+		return nil, err
 	}
 
-	provider := &CustomProvider{cfg: cm.cfg}
-	if err := client.Challenge.SetHTTP01Provider(provider); err != nil {
-		logrus.Errorf("Error setting HTTP-01 provider: %v", err)
-		return nil, nil, errors.Wrap(err, "Failed to set HTTP-01 provider")
+	log := logging.FromContext(ctx)
+	log.Infof("Registering ACME account with external account binding key ID: %s", keyID)
+
+	return client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+		TermsOfServiceAgreed: true,
+		Kid:                  keyID,
+		HmacEncoded:          hmacKey,
+	})
+}
+
+// Issue obtains a certificate for the task domain from the task issuer, replacesCertID is the ARI identifier of the certificate being renewed and can be empty
+func (cm *CertManager) Issue(ctx context.Context, task CertTask, replacesCertID string) (cert *sink.Certificate, err error) {
+	ctx, span := tracing.Start(ctx, "Issue", attribute.String("certmanager.issuer", task.Issuer))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	// local issuers don't reach out to anything, so they issue also in dry run mode
+	switch task.Issuer {
+	case IssuerSelfSigned:
+		return cm.issueSelfSigned(ctx, task)
+	case IssuerCA:
+		return cm.issueFromCA(ctx, task)
 	}
 
-	reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	if cm.cfg.DryRun {
+		return cm.dryRunIssue(ctx, task)
+	}
+
+	return cm.issueACME(ctx, task, replacesCertID)
+}
+
+func (cm *CertManager) issueACME(ctx context.Context, task CertTask, replacesCertID string) (*sink.Certificate, error) {
+	acmeCfg, email, domain := task.ACME, task.Email, task.Domain
+	log := logging.FromContext(ctx)
+	log.Infof("Starting certificate issuance process using ACME directory %s", cm.directoryURL(acmeCfg))
+
+	user, err := cm.loadAccount(ctx, acmeCfg, email)
 	if err != nil {
-		logrus.Errorf("Error registering user: %v", err)
-		return nil, nil, errors.Wrap(err, "Failed to register user")
+		log.Errorf("Error loading ACME account: %v", err)
+		return nil, err
+	}
+	log.Infof("Defined ACME user with email: %s", email)
+	// the CA accepts replacements only from the account which ordered the replaced certificate
+	if replacesCertID != "" && user.Registration == nil {
+		log.Debug("The ACME account is new, ordering without replacing the current certificate")
+		replacesCertID = ""
+	}
+
+	client, err := cm.newACMEClient(user, acmeCfg, keyTypes[task.KeyType])
+	if err != nil {
+		log.Errorf("Error creating ACME client: %v", err)
+		return nil, errors.Wrap(err, "Failed to create ACME client")
+	}
+
+	provider, err := cm.newProvider(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Challenge.SetHTTP01Provider(provider); err != nil {
+		log.Errorf("Error setting HTTP-01 provider: %v", err)
+		return nil, errors.Wrap(err, "Failed to set HTTP-01 provider")
+	}
+
+	if err := cm.selfCheck(ctx, provider, domain); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	if user.Registration == nil {
+		reg, err := cm.register(ctx, client, acmeCfg)
+		if err != nil {
+			log.Errorf("Error registering user: %v", err)
+			return nil, errors.Wrap(err, "Failed to register user")
+		}
+		user.Registration = reg
+
+		if err := cm.saveAccount(ctx, acmeCfg, user); err != nil {
+			log.Errorf("The registered account will not be reused: %v", err)
+		}
 	}
-	user.Registration = reg
 
 	request := certificate.ObtainRequest{
-		Domains: []string{domain},
-		Bundle:  true,
+		Domains:        []string{domain},
+		Bundle:         true,
+		ReplacesCertID: replacesCertID,
 	}
 
-	certRes, err := cm.obtain(request, client, domain)
+	certRes, err := cm.obtain(ctx, request, client, domain)
+	if err != nil && request.ReplacesCertID != "" && replacesRejected(err) {
+		log.Warnf("CA refused to replace certificate %s, ordering without replacing it: %v", request.ReplacesCertID, err)
+		cm.clearRenewalInfo(ctx, task)
+		request.ReplacesCertID = ""
+		certRes, err = cm.obtain(ctx, request, client, domain)
+	}
 	if err != nil {
-		logrus.Errorf("Error obtaining certificate: %v", err)
+		log.Errorf("Error obtaining certificate: %v", err)
 		if err2 := provider.Cleanup(); err2 != nil {
-			logrus.Errorf("Cleanup failed: %v", err2)
+			log.Errorf("Cleanup failed: %v", err2)
 		}
-		return nil, nil, errors.Wrap(err, "Failed to obtain certificate")
+		return nil, errors.Wrap(err, "Failed to obtain certificate")
 	}
 
-	logrus.Infof(
+	log.Infof(
 		"Certificate successfully obtained, CertURL: %s, CertStableURL: %s, Domain: %s",
 		certRes.CertURL,
 		certRes.CertStableURL,
 		certRes.Domain,
 	)
 
-	return certRes.Certificate, certRes.PrivateKey, nil
+	return &sink.Certificate{
+		CertPEM: certRes.Certificate,
+		KeyPEM:  certRes.PrivateKey,
+		CertURL: certRes.CertURL,
+	}, nil
 }
 
-func (cm *CertManager) obtain(request certificate.ObtainRequest, client *lego.Client, domain string) (cert *certificate.Resource, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), cm.cfg.CertIssTimeout)
+// newACMEClient creates a client for the task CA, certificate keys are RSA 2048 if keyType is empty
+func (cm *CertManager) newACMEClient(user *User, acmeCfg *ACMEConfig, keyType certcrypto.KeyType) (*lego.Client, error) {
+	config := lego.NewConfig(user)
+	config.CADirURL = cm.directoryURL(acmeCfg)
+	if keyType != "" {
+		config.Certificate.KeyType = keyType
+	}
+
+	return lego.NewClient(config)
+}
+
+func (cm *CertManager) obtain(
+	ctx context.Context,
+	request certificate.ObtainRequest,
+	client *lego.Client,
+	domain string,
+) (cert *certificate.Resource, err error) {
+	ctx, span := tracing.Start(ctx, "acme.obtain")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	log := logging.FromContext(ctx)
+	ctx, cancel := context.WithTimeout(ctx, cm.cfg.CertIssTimeout)
 	defer cancel()
 
-	logrus.Infof(
+	log.Infof(
 		"Requesting certificate for domain: %s with timeout: %v",
 		domain,
 		cm.cfg.CertIssTimeout,
@@ -188,7 +377,11 @@ func (cm *CertManager) obtain(request certificate.ObtainRequest, client *lego.Cl
 
 		return certRes, nil
 	case <-ctx.Done():
-		logrus.Errorf("Obtain operation timed out after %v", cm.cfg.CertIssTimeout)
+		if ctx.Err() == context.Canceled {
+			log.Warn("Obtain operation aborted by shutdown")
+			return nil, errors.New("Obtain operation aborted by shutdown")
+		}
+		log.Errorf("Obtain operation timed out after %v", cm.cfg.CertIssTimeout)
 		return nil, fmt.Errorf("Obtain operation timed out after %v", cm.cfg.CertIssTimeout)
 	}
 }
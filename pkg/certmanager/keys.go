@@ -0,0 +1,113 @@
+package certmanager
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var jsonUnmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// canonicalKeys renames the object keys of a generically decoded config to the field names of the target type.
+// A key is accepted as written in the field tag or in lower case, e.g. "Domain" or "domain", like in the
+// published schema. encoding/json would match any spelling, so other spellings are rejected here
+func canonicalKeys(value interface{}, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PointerTo(t).Implements(jsonUnmarshaler) {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		fields := map[string]reflect.StructField{}
+		collectFields(t, fields)
+		names := make(map[string]string, len(fields)*2)
+		for name := range fields {
+			names[name] = name
+			names[strings.ToLower(name)] = name
+		}
+
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		renamed := make(map[string]interface{}, len(object))
+		for _, key := range keys {
+			name, ok := names[key]
+			if !ok {
+				return errors.Errorf("unknown field %q", path+key)
+			}
+			if _, ok := renamed[name]; ok {
+				return errors.Errorf("field %q is set more than once", path+name)
+			}
+			if err := canonicalKeys(object[key], fields[name].Type, path+name+"."); err != nil {
+				return err
+			}
+			renamed[name] = object[key]
+			delete(object, key)
+		}
+		for name, v := range renamed {
+			object[name] = v
+		}
+	case reflect.Slice, reflect.Array:
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, item := range items {
+			if err := canonicalKeys(item, t.Elem(), path+strconv.Itoa(i)+"."); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		// map keys are user data like labels, only the values are checked
+		entries, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for key, entry := range entries {
+			if err := canonicalKeys(entry, t.Elem(), path+key+"."); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// collectFields lists the JSON names of the struct fields, fields of embedded structs are promoted like in encoding/json
+func collectFields(t reflect.Type, fields map[string]reflect.StructField) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" && field.Anonymous {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				collectFields(embedded, fields)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field
+	}
+}
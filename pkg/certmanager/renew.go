@@ -0,0 +1,157 @@
+package certmanager
+
+import (
+	"context"
+	"fmt"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/breathbath/certmanager/pkg/sink"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+const (
+	RenewStatusRenewed    = "renewed"
+	RenewStatusWouldRenew = "would-renew"
+	RenewStatusFailed     = "failed"
+)
+
+// RenewFilter selects the configured tasks which should be reissued
+type RenewFilter struct {
+	// Secrets are given in the namespace/name form
+	Secrets []string
+	Domains []string
+	All     bool
+}
+
+func (f RenewFilter) Validate() error {
+	if !f.All && len(f.Secrets) == 0 && len(f.Domains) == 0 {
+		return errors.New("one of secret, domain or all must be set")
+	}
+
+	for _, s := range f.Secrets {
+		if _, _, err := ParseSecretRef(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f RenewFilter) Matches(task CertTask) bool {
+	if f.All {
+		return true
+	}
+
+	for _, s := range f.Secrets {
+		namespace, name, _ := ParseSecretRef(s)
+		if namespace == task.Namespace && name == task.Secret {
+			return true
+		}
+	}
+
+	for _, d := range f.Domains {
+		if strings.EqualFold(strings.TrimSpace(d), task.Domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseSecretRef splits a namespace/name reference into its parts
+func ParseSecretRef(ref string) (namespace, name string, err error) {
+	parts := strings.Split(strings.TrimSpace(ref), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("invalid secret reference %q, expected namespace/name", ref)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+type RenewResult struct {
+	Task   CertTask
+	Status string
+	Detail string
+	Err    error
+}
+
+func (r RenewResult) String() string {
+	target := r.Task.Namespace + "/" + r.Task.Secret
+	if r.Task.Files != nil {
+		target = r.Task.Files.Cert
+	}
+
+	line := fmt.Sprintf("%s (%s): %s", target, r.Task.Domain, r.Status)
+	if r.Detail != "" {
+		line += ", " + r.Detail
+	}
+	if r.Err != nil {
+		line += ": " + r.Err.Error()
+	}
+
+	return line
+}
+
+// Renew reissues certificates of all tasks matching the filter skipping the validity check,
+// in dry run mode the renewal is planned and the current state of the matched secrets is reported
+func (cm *CertManager) Renew(ctx context.Context, filter RenewFilter) ([]RenewResult, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	ctx = logging.WithFields(ctx, logrus.Fields{logging.FieldRunID: logging.NewRunID()})
+
+	results := []RenewResult{}
+	for _, task := range cm.cfg.CertTasks {
+		if !filter.Matches(task) {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			results = append(results, RenewResult{Task: task, Status: RenewStatusFailed, Err: ctx.Err()})
+			continue
+		}
+
+		taskCtx := taskContext(ctx, task)
+		logging.FromContext(taskCtx).Infof("Forcing renewal of %s for domain %s", task.Target(), task.Domain)
+		err := cm.ensureTask(taskCtx, task, true)
+		if err != nil {
+			results = append(results, RenewResult{Task: task, Status: RenewStatusFailed, Err: err})
+			continue
+		}
+		if cm.cfg.DryRun {
+			results = append(results, cm.planRenewal(ctx, task))
+			continue
+		}
+		results = append(results, RenewResult{Task: task, Status: RenewStatusRenewed})
+	}
+
+	if len(results) == 0 {
+		return nil, errors.New("no configured tasks match the given filter")
+	}
+
+	return results, nil
+}
+
+func (cm *CertManager) planRenewal(ctx context.Context, task CertTask) RenewResult {
+	chainPEM, err := cm.storedChain(ctx, task)
+	if err != nil {
+		return RenewResult{Task: task, Status: RenewStatusWouldRenew, Detail: "current certificate is unreadable", Err: err}
+	}
+	if chainPEM == nil {
+		return RenewResult{Task: task, Status: RenewStatusWouldRenew, Detail: "no certificate is stored yet"}
+	}
+
+	cert, err := sink.ParseLeaf(chainPEM)
+	if err != nil {
+		return RenewResult{Task: task, Status: RenewStatusWouldRenew, Detail: "current certificate is unreadable", Err: err}
+	}
+
+	return RenewResult{
+		Task:   task,
+		Status: RenewStatusWouldRenew,
+		Detail: fmt.Sprintf("current certificate expires at %s", cert.NotAfter.UTC().Format(time.RFC3339)),
+	}
+}
@@ -0,0 +1,51 @@
+package certmanager
+
+import (
+	"context"
+	"fmt"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/breathbath/certmanager/pkg/notify"
+	"github.com/breathbath/certmanager/pkg/revocation"
+	"time"
+)
+
+// checkRevocation reports whether the certificate stored by the task was revoked by its CA,
+// lookup failures are logged and treated as not revoked so an unreachable responder doesn't cause reissues
+func (cm *CertManager) checkRevocation(ctx context.Context, task CertTask) bool {
+	if !cm.cfg.RevocationCheck || !task.isACME() {
+		return false
+	}
+
+	log := logging.FromContext(ctx)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	chainPEM, err := cm.storedChain(ctx, task)
+	if err != nil || chainPEM == nil {
+		return false
+	}
+
+	res, err := cm.revocations.CheckPEM(ctx, chainPEM)
+	if err != nil {
+		log.Warnf("Failed to check revocation status of %s: %v", task.Target(), err)
+		return false
+	}
+
+	log.Debugf("Revocation status of %s is %s via %s", task.Target(), res.Status, res.Source)
+	if res.Status != revocation.StatusRevoked {
+		return false
+	}
+
+	message := fmt.Sprintf("revoked at %s with reason code %d according to %s", res.RevokedAt.UTC().Format(time.RFC3339), res.Reason, res.Source)
+	log.Warnf("Certificate in %s was %s, forcing reissue", task.Target(), message)
+	cm.notify(ctx, notify.Event{
+		Type:      notify.EventRevoked,
+		Namespace: task.Namespace,
+		Secret:    task.Secret,
+		Domain:    task.Domain,
+		Path:      task.filesPath(),
+		Message:   message,
+	}, task.Notify)
+
+	return true
+}
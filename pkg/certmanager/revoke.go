@@ -0,0 +1,114 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+)
+
+// revocationReasons maps RFC 5280 reason names to their codes
+var revocationReasons = map[string]uint{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+}
+
+func RevocationReasons() []string {
+	names := make([]string, 0, len(revocationReasons))
+	for name := range revocationReasons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func parseRevocationReason(reason string) (uint, error) {
+	code, ok := revocationReasons[reason]
+	if !ok {
+		return 0, errors.Errorf("unknown revocation reason %q, expected one of %s", reason, strings.Join(RevocationReasons(), ", "))
+	}
+
+	return code, nil
+}
+
+// Revoke revokes the certificate authorizing the request with the certificate's own private key,
+// so it works for certificates issued by any ACME account of the CA
+func (cm *CertManager) Revoke(acmeCfg *ACMEConfig, certPEM, keyPEM []byte, reason string) error {
+	reasonCode, err := parseRevocationReason(reason)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return errors.Wrap(err, "certificate and private key don't match")
+	}
+
+	certKey, err := certcrypto.ParsePEMPrivateKey(keyPEM)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse certificate private key")
+	}
+
+	client, err := cm.newACMEClient(&User{Key: certKey}, acmeCfg, "")
+	if err != nil {
+		return errors.Wrap(err, "Failed to create ACME client")
+	}
+
+	if cm.cfg.DryRun {
+		logrus.Infof("dry run: would revoke certificate with reason %s", reason)
+		return nil
+	}
+
+	logrus.Infof("Revoking certificate with reason %s", reason)
+	err = client.Certificate.RevokeWithReason(certPEM, &reasonCode)
+	if err != nil {
+		return errors.Wrap(err, "Failed to revoke certificate")
+	}
+
+	logrus.Info("Certificate successfully revoked")
+
+	return nil
+}
+
+// RevokeSecret revokes the certificate currently stored in the secret
+func (cm *CertManager) RevokeSecret(ctx context.Context, acmeCfg *ACMEConfig, namespace, secretName, reason string) error {
+	kubeSecrets, err := cm.kubernetes()
+	if err != nil {
+		return err
+	}
+
+	secret, err := kubeSecrets.GetSecret(ctx, namespace, secretName)
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return errors.Errorf("secret %s/%s doesn't exist", namespace, secretName)
+	}
+
+	return cm.Revoke(acmeCfg, secret.Data["tls.crt"], secret.Data["tls.key"], reason)
+}
+
+// FindTask returns the configured task writing the given secret
+func (cm *CertManager) FindTask(namespace, secretName string) (CertTask, bool) {
+	for _, task := range cm.cfg.CertTasks {
+		if task.Namespace == namespace && task.Secret == secretName {
+			return task, true
+		}
+	}
+
+	return CertTask{}, false
+}
+
+// Reissue issues a new certificate for the task skipping the validity check
+func (cm *CertManager) Reissue(ctx context.Context, task CertTask) error {
+	ctx = logging.WithFields(ctx, logrus.Fields{logging.FieldRunID: logging.NewRunID()})
+
+	return cm.ensureTask(taskContext(ctx, task), task, true)
+}
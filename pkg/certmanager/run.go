@@ -2,15 +2,31 @@ package certmanager
 
 import (
 	"context"
+	"github.com/breathbath/certmanager/pkg/backup"
+	"github.com/breathbath/certmanager/pkg/challenge"
 	"github.com/breathbath/certmanager/pkg/k8s"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/breathbath/certmanager/pkg/notify"
+	"github.com/breathbath/certmanager/pkg/revocation"
+	"github.com/breathbath/certmanager/pkg/sink"
+	"github.com/breathbath/certmanager/pkg/tracing"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
+	"strings"
 	"time"
 )
 
 type CertManager struct {
 	cfg               *Config
 	kubeSecretManager *k8s.SecretManager
+	restarter         *k8s.WorkloadRestarter
+	notifier          *notify.Notifier
+	// backups keeps certificates which couldn't be stored, nil if CERTMANAGER_BACKUP_PATH isn't set
+	backups     *backup.Store
+	revocations *revocation.Checker
+	// tokens receives the HTTP-01 challenge tokens served by the challenge server
+	tokens challenge.TokenStore
 }
 
 func NewCertManager() (*CertManager, error) {
@@ -19,20 +35,62 @@ func NewCertManager() (*CertManager, error) {
 		return nil, err
 	}
 
+	var backups *backup.Store
+	if strings.TrimSpace(cfg.BackupPath) != "" {
+		backups, err = backup.NewStore(&cfg.Config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	notifyCfg, err := notify.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	cm := &CertManager{
+		cfg:         cfg,
+		backups:     backups,
+		notifier:    notify.NewNotifier(notifyCfg),
+		revocations: revocation.NewChecker(nil),
+	}
+	if cfg.ChallengePath != "" {
+		cm.tokens = challenge.NewDirStore(cfg.ChallengePath)
+	}
+
+	// hosts which only write certificate files run without a cluster
+	if !cfg.needsKubernetes() {
+		logrus.Info("No task uses Kubernetes, running without a Kubernetes client")
+		return cm, nil
+	}
+
 	clientset, err := k8s.NewClient()
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to create Kubernetes client")
 	}
+	cm.kubeSecretManager = k8s.NewSecretManager(clientset, backups, cfg.DryRun)
+	cm.restarter = k8s.NewWorkloadRestarter(clientset, cfg.DryRun)
 
-	sm := k8s.NewSecretManager(clientset)
+	return cm, nil
+}
 
-	return &CertManager{
-		cfg:               cfg,
-		kubeSecretManager: sm,
-	}, nil
+// SetTokenStore replaces the challenge directory, e.g. by a store shared with a challenge server in the same process
+func (cm *CertManager) SetTokenStore(tokens challenge.TokenStore) {
+	cm.tokens = tokens
+}
+
+// kubernetes returns the secret manager or an error if the manager runs without a Kubernetes client
+func (cm *CertManager) kubernetes() (*k8s.SecretManager, error) {
+	if cm.kubeSecretManager == nil {
+		return nil, errors.New("no Kubernetes client, all configured tasks write files")
+	}
+
+	return cm.kubeSecretManager, nil
 }
 
 func (cm *CertManager) RunPeriodically(mainCtx context.Context) {
+	go cm.watchNamespaces(mainCtx)
+
 	logrus.Infof(
 		"Waiting for initial delay of %v before starting periodic checks",
 		cm.cfg.InitialDelay,
@@ -42,7 +100,7 @@ func (cm *CertManager) RunPeriodically(mainCtx context.Context) {
 	select {
 	case <-time.After(cm.cfg.InitialDelay):
 		logrus.Info("Running the initial secret check after delay...")
-		cm.runTasks()
+		cm.runTasks(mainCtx)
 	case <-mainCtx.Done():
 		return
 	}
@@ -56,31 +114,272 @@ func (cm *CertManager) RunPeriodically(mainCtx context.Context) {
 		select {
 		case <-ticker.C:
 			logrus.Info("Running periodic secret check...")
-			cm.runTasks()
+			cm.runTasks(mainCtx)
 		case <-mainCtx.Done():
 			return
 		}
 	}
 }
 
-func (cm *CertManager) runTasks() {
+// runTasks checks all tasks, a running issuance is aborted and the remaining tasks are skipped when the context is done
+func (cm *CertManager) runTasks(ctx context.Context) {
+	ctx, span := tracing.Start(ctx, "runTasks")
+	defer span.End()
+	ctx = logging.WithFields(ctx, logrus.Fields{logging.FieldRunID: logging.NewRunID()})
+
 	for _, task := range cm.cfg.CertTasks {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
+		if ctx.Err() != nil {
+			logging.FromContext(ctx).Info("Stopping secret checks")
+			return
+		}
+		taskCtx := taskContext(ctx, task)
+		err := cm.ensureTask(taskCtx, task, false)
+		if err != nil {
+			logging.FromContext(taskCtx).Error(err)
+		} else {
+			logging.FromContext(taskCtx).Info("Secret check completed successfully")
+		}
+	}
+}
+
+// taskContext adds the task fields to the logger in the context
+func taskContext(ctx context.Context, task CertTask) context.Context {
+	return logging.WithFields(ctx, logrus.Fields{
+		logging.FieldNamespace: task.Namespace,
+		logging.FieldSecret:    task.Secret,
+		logging.FieldDomain:    task.Domain,
+	})
+}
+
+func (cm *CertManager) ensureTask(ctx context.Context, task CertTask, force bool) (err error) {
+	ctx, span := tracing.Start(ctx, "ensureTask", tracing.Task(task.Namespace, task.Secret, task.Domain)...)
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	log := logging.FromContext(ctx)
+
+	revoked := cm.checkRevocation(ctx, task)
+	ari := cm.checkRenewalInfo(ctx, task)
+
+	// a shutdown aborts a running issuance, storing an issued certificate and the steps after it still finish
+	issueCtx := ctx
+	ctx = context.WithoutCancel(ctx)
+
+	// the deadline covers the issuance which is limited by the issue timeout itself
+	ensureCtx, cancel := context.WithTimeout(ctx, cm.cfg.CertIssTimeout+time.Minute)
+	defer cancel()
+
+	force = force || revoked || ari.RenewNow
+	renewBefore := cm.renewBefore(task)
+	if ari.Scheduled {
+		// the CA decides when to renew, only an expired certificate is replaced regardless of the schedule
+		renewBefore = 0
+	}
+	issue := func() (*sink.Certificate, error) {
+		return cm.Issue(issueCtx, task, ari.ReplacesCertID)
+	}
+
+	var res *sink.Result
+	if task.Files != nil {
+		res, err = sink.Ensure(
+			ensureCtx,
+			cm.fileSink(task),
+			sink.Request{Domain: task.Domain, Force: force, RenewBefore: renewBefore},
+			issue,
+		)
+	} else {
+		res, err = cm.kubeSecretManager.EnsureTLSSecret(
+			ensureCtx,
+			k8s.TLSSecretRequest{
+				Namespace:   task.Namespace,
+				Domain:      task.Domain,
+				SecretName:  task.Secret,
+				Email:       task.Email,
+				Force:       force,
+				RenewBefore: renewBefore,
+				Outputs:     outputs(task),
+			},
+			func(_, _ string) (*sink.Certificate, error) {
+				return issue()
+			},
+		)
+	}
+	if err != nil && issueCtx.Err() != nil {
+		return errors.Wrap(err, "certificate check aborted by shutdown")
+	}
+	cm.notifyResult(ctx, task, res, err)
+	if err != nil {
+		return err
+	}
+	if cm.cfg.DryRun {
+		action := "keep the current certificate"
+		if res.Renewed {
+			action = "issue a new certificate"
+		}
+		log.Infof("dry run: plan for %s (%s): %s", task.Target(), task.Domain, action)
+	}
+
+	// namespaces where the secret content has changed
+	changed := []string{}
+	if res.Renewed {
+		changed = append(changed, task.Namespace)
+	}
+
+	replicated, replicateErr := cm.replicate(ctx, task)
+	changed = append(changed, replicated...)
+
+	err = cm.restartWorkloads(ctx, task, changed)
+	if err != nil {
+		return err
+	}
+
+	return replicateErr
+}
 
-		err := cm.kubeSecretManager.EnsureTLSSecret(
-			ctx,
-			task.Namespace,
-			task.Domain,
+// replicate copies the task secret to its replica namespaces
+func (cm *CertManager) replicate(ctx context.Context, task CertTask) ([]string, error) {
+	if !task.IsReplicated() {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	namespaces, err := cm.kubeSecretManager.ResolveNamespaces(ctx, task.Namespaces, task.NamespaceSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	return cm.kubeSecretManager.ReplicateTLSSecret(ctx, task.Namespace, task.Secret, namespaces)
+}
+
+func (cm *CertManager) restartWorkloads(ctx context.Context, task CertTask, namespaces []string) error {
+	if task.Rollout == nil || len(namespaces) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	failed := []string{}
+	for _, namespace := range namespaces {
+		err := cm.restarter.Restart(ctx, namespace, task.Secret, task.Rollout)
+		if err != nil {
+			logging.FromContext(ctx).Error(err)
+			failed = append(failed, namespace)
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf(
+			"secret %s was updated but dependent workloads were not restarted in namespaces %s",
 			task.Secret,
-			task.Email,
-			cm.cfg.BackupPath,
-			cm.Issue,
+			strings.Join(failed, ", "),
 		)
+	}
+
+	return nil
+}
+
+// watchNamespaces copies replicated secrets into matching namespaces as soon as they are created
+func (cm *CertManager) watchNamespaces(ctx context.Context) {
+	tasks := []CertTask{}
+	for _, task := range cm.cfg.CertTasks {
+		if task.NamespaceSelector != "" {
+			tasks = append(tasks, task)
+		}
+	}
+	if len(tasks) == 0 {
+		return
+	}
+
+	logrus.Info("Watching new namespaces for secret replication")
+	for ctx.Err() == nil {
+		err := cm.kubeSecretManager.WatchNewNamespaces(ctx, func(namespace string, nsLabels labels.Set) {
+			for _, task := range tasks {
+				selector, err := labels.Parse(task.NamespaceSelector)
+				if err != nil || !selector.Matches(nsLabels) {
+					continue
+				}
+
+				logrus.Infof("Replicating secret %s/%s to new namespace %s", task.Namespace, task.Secret, namespace)
+				replicateCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+				_, err = cm.kubeSecretManager.ReplicateTLSSecret(replicateCtx, task.Namespace, task.Secret, []string{namespace})
+				cancel()
+				if err != nil {
+					logrus.Error(err)
+				}
+			}
+		})
 		if err != nil {
-			logrus.Error(err)
-		} else {
-			logrus.Info("Secret check completed successfully")
+			logrus.Errorf("Namespace watch failed, retrying: %v", err)
+			select {
+			case <-time.After(30 * time.Second):
+			case <-ctx.Done():
+			}
 		}
 	}
 }
+
+func (cm *CertManager) fileSink(task CertTask) *sink.FileSink {
+	return sink.NewFileSink(task.Files, cm.backups, cm.cfg.DryRun)
+}
+
+// storedChain returns the certificate chain currently stored for the task, nil if there is none
+func (cm *CertManager) storedChain(ctx context.Context, task CertTask) ([]byte, error) {
+	if task.Files != nil {
+		return cm.fileSink(task).LoadPEM()
+	}
+
+	secret, err := cm.kubeSecretManager.GetSecret(ctx, task.Namespace, task.Secret)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+
+	return secret.Data["tls.crt"], nil
+}
+
+// renewBefore is the fixed renewal window used when the CA gives no renewal information
+func (cm *CertManager) renewBefore(task CertTask) time.Duration {
+	return cm.cfg.renewBefore(task)
+}
+
+func (cm *CertManager) notifyResult(ctx context.Context, task CertTask, res *sink.Result, err error) {
+	event := notify.Event{
+		Namespace: task.Namespace,
+		Secret:    task.Secret,
+		Domain:    task.Domain,
+		NotAfter:  res.NotAfter,
+		Path:      task.filesPath(),
+	}
+	if err != nil {
+		event.Message = err.Error()
+	}
+
+	switch {
+	case res.IssueFailed:
+		event.Type = notify.EventIssueFailed
+	case res.WriteFailed:
+		event.Type = notify.EventWriteFailed
+		event.BackupPath = res.BackupPath
+	case res.Renewed:
+		event.Type = notify.EventRenewed
+	case err == nil && !res.NotAfter.IsZero() && time.Until(res.NotAfter) < cm.notifier.ExpiryThreshold(task.Notify):
+		event.Type = notify.EventExpiring
+	default:
+		return
+	}
+
+	cm.notify(ctx, event, task.Notify)
+}
+
+// notify sends the event unless running in dry run mode
+func (cm *CertManager) notify(ctx context.Context, event notify.Event, taskCfg *notify.TaskConfig) {
+	if cm.cfg.DryRun {
+		logging.FromContext(ctx).Infof("dry run: would send notification: %s", event.Summary())
+		return
+	}
+
+	cm.notifier.Notify(ctx, event, taskCfg)
+}
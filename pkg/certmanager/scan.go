@@ -0,0 +1,154 @@
+package certmanager
+
+import (
+	"context"
+	"github.com/breathbath/certmanager/pkg/k8s"
+	"github.com/breathbath/certmanager/pkg/metrics"
+	"github.com/breathbath/certmanager/pkg/notify"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+)
+
+type ScanResult struct {
+	Namespace string
+	Secret    string
+	Domain    string
+	// Managed is set if the secret is written by one of the configured tasks
+	Managed  bool
+	NotAfter time.Time
+	Expiring bool
+	Err      error
+}
+
+// Scan checks expiry of all TLS secrets in the configured namespaces without modifying them
+func (cm *CertManager) Scan(ctx context.Context, namespaces []string) ([]ScanResult, error) {
+	kubeSecrets, err := cm.kubernetes()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+
+	results := []ScanResult{}
+	for _, namespace := range namespaces {
+		secrets, err := kubeSecrets.ListTLSSecrets(ctx, namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range secrets {
+			secret := &secrets[i]
+			_, managed := cm.FindTask(secret.Namespace, secret.Name)
+			if _, isReplica := secret.Annotations[k8s.AnnotationReplicaOf]; isReplica {
+				managed = true
+			}
+			res := ScanResult{
+				Namespace: secret.Namespace,
+				Secret:    secret.Name,
+				Managed:   managed,
+			}
+
+			cert, err := k8s.ParseCertificate(secret)
+			if err != nil {
+				res.Err = err
+				results = append(results, res)
+				continue
+			}
+
+			res.NotAfter = cert.NotAfter
+			res.Domain = cert.Subject.CommonName
+			if len(cert.DNSNames) > 0 {
+				res.Domain = cert.DNSNames[0]
+			}
+			res.Expiring = !kubeSecrets.IsCertValid(secret, cm.cfg.ScanWarnBefore)
+			results = append(results, res)
+		}
+	}
+
+	return results, nil
+}
+
+// ScanPeriodically reports expiring TLS secrets through logs, metrics and notifications
+func (cm *CertManager) ScanPeriodically(mainCtx context.Context) {
+	if !cm.cfg.ScanEnabled {
+		return
+	}
+
+	logrus.Infof("Starting TLS secret expiry scans every %s", cm.cfg.ScanInterval)
+
+	ticker := time.NewTicker(cm.cfg.ScanInterval)
+	defer ticker.Stop()
+
+	for {
+		cm.runScan(mainCtx)
+
+		select {
+		case <-ticker.C:
+		case <-mainCtx.Done():
+			return
+		}
+	}
+}
+
+func (cm *CertManager) runScan(mainCtx context.Context) {
+	ctx, cancel := context.WithTimeout(mainCtx, time.Minute)
+	defer cancel()
+
+	results, err := cm.Scan(ctx, cm.cfg.ScanNamespaces)
+	if err != nil {
+		logrus.Errorf("TLS secret scan failed: %v", err)
+		return
+	}
+
+	metrics.SecretExpiry.Reset()
+	metrics.SecretExpiring.Reset()
+	metrics.SecretInvalid.Reset()
+
+	expiring := 0
+	for _, res := range results {
+		managed := strconv.FormatBool(res.Managed)
+
+		if res.Err != nil {
+			logrus.Warnf("TLS secret %s/%s contains no valid certificate: %v", res.Namespace, res.Secret, res.Err)
+			metrics.SecretInvalid.WithLabelValues(res.Namespace, res.Secret, managed).Set(1)
+			continue
+		}
+
+		metrics.SecretInvalid.WithLabelValues(res.Namespace, res.Secret, managed).Set(0)
+		metrics.SecretExpiry.WithLabelValues(res.Namespace, res.Secret, managed).Set(float64(res.NotAfter.Unix()))
+
+		if !res.Expiring {
+			metrics.SecretExpiring.WithLabelValues(res.Namespace, res.Secret, managed).Set(0)
+			continue
+		}
+
+		expiring++
+		metrics.SecretExpiring.WithLabelValues(res.Namespace, res.Secret, managed).Set(1)
+		logrus.Warnf(
+			"TLS secret %s/%s (%s) expires at %s, managed by certmanager: %v",
+			res.Namespace,
+			res.Secret,
+			res.Domain,
+			res.NotAfter.UTC().Format(time.RFC3339),
+			res.Managed,
+		)
+
+		// managed secrets are reported by the renewal loop
+		if !res.Managed {
+			cm.notify(ctx, notify.Event{
+				Type:      notify.EventExpiring,
+				Namespace: res.Namespace,
+				Secret:    res.Secret,
+				Domain:    res.Domain,
+				NotAfter:  res.NotAfter,
+				Message:   "unmanaged TLS secret is close to expiry",
+			}, nil)
+		}
+	}
+
+	metrics.ScanTimestamp.SetToCurrentTime()
+	logrus.Infof("TLS secret scan completed, checked %d secrets, %d expiring", len(results), expiring)
+}
@@ -0,0 +1,132 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/breathbath/certmanager/pkg/tracing"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+const challengePathPrefix = "/.well-known/acme-challenge/"
+
+// selfCheck presents a random probe token with the provider and fetches it from the domain over HTTP the same way
+// the ACME server does, so broken challenge routing is reported before an order is placed
+func (cm *CertManager) selfCheck(ctx context.Context, provider challenge.Provider, domain string) (err error) {
+	if !cm.cfg.SelfCheckEnabled {
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, "selfCheck")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	log := logging.FromContext(ctx)
+
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	probe, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	if err := provider.Present(domain, token, probe); err != nil {
+		return errors.Wrap(err, "self-check failed to present the probe token")
+	}
+	defer func() {
+		if err := provider.CleanUp(domain, token, probe); err != nil {
+			log.Warnf("Failed to clean up self-check probe token: %v", err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, cm.cfg.SelfCheckTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s%s%s", domain, challengePathPrefix, token)
+	log.Infof("Running HTTP-01 self-check against %s", url)
+
+	return checkProbe(ctx, http.DefaultClient, url, domain, probe)
+}
+
+func checkProbe(ctx context.Context, client *http.Client, url, domain, probe string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return errors.Wrap(err, "self-check failed to create request")
+	}
+	// the challenge server logs the trace ID of the probe request
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return diagnoseRequestError(err, domain)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errors.Errorf(
+			"self-check failed: %s returned 404, requests to %s are not routed to the challenge server "+
+				"or the challenge path is not shared with it",
+			url,
+			challengePathPrefix,
+		)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("self-check failed: %s returned unexpected status %d", url, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return errors.Wrapf(err, "self-check failed to read response from %s", url)
+	}
+	if strings.TrimSpace(string(body)) != probe {
+		return errors.Errorf(
+			"self-check failed: %s returned a wrong body, the domain is probably served by another server",
+			url,
+		)
+	}
+
+	logging.FromContext(ctx).Infof("HTTP-01 self-check for %s succeeded", domain)
+
+	return nil
+}
+
+func diagnoseRequestError(err error, domain string) error {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return errors.Wrapf(err, "self-check failed: DNS lookup of %s failed", domain)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errors.Wrapf(err, "self-check failed: connection to %s on port 80 was refused", domain)
+	case errors.Is(err, context.DeadlineExceeded) || isTimeout(err):
+		return errors.Wrapf(err, "self-check failed: request to %s timed out", domain)
+	default:
+		return errors.Wrapf(err, "self-check failed: request to %s failed", domain)
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "failed to generate self-check token")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
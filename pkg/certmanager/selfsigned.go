@@ -0,0 +1,154 @@
+package certmanager
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/breathbath/certmanager/pkg/sink"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/pkg/errors"
+	"math/big"
+	"net"
+	"net/url"
+	"time"
+)
+
+const defaultValidity = 90 * 24 * time.Hour
+
+// validity is the lifetime of certificates from local issuers
+func (t CertTask) validity() time.Duration {
+	if t.Validity != nil {
+		return t.Validity.Duration
+	}
+
+	return defaultValidity
+}
+
+// dnsNames lists the task domain followed by the additional DNS names without duplicates
+func (t CertTask) dnsNames() []string {
+	names := []string{t.Domain}
+	seen := map[string]bool{t.Domain: true}
+	for _, name := range t.DNSNames {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// issueSelfSigned creates a certificate signed by its own key, nothing leaves the cluster
+func (cm *CertManager) issueSelfSigned(ctx context.Context, task CertTask) (*sink.Certificate, error) {
+	logging.FromContext(ctx).Infof("Issuing self-signed certificate for %s valid for %s", task.Domain, task.validity())
+
+	key, err := generateKey(task.KeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := leafTemplate(task, key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create self-signed certificate")
+	}
+
+	return &sink.Certificate{
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  certcrypto.PEMEncode(key),
+	}, nil
+}
+
+// generateKey creates a private key of the configured type, RSA 2048 is used by default
+func generateKey(keyType string) (crypto.Signer, error) {
+	kt, ok := keyTypes[keyType]
+	if !ok || kt == "" {
+		kt = certcrypto.RSA2048
+	}
+
+	key, err := certcrypto.GeneratePrivateKey(kt)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate %s private key", kt)
+	}
+
+	return key.(crypto.Signer), nil
+}
+
+// parseURI parses a URI SAN like spiffe://cluster.local/ns/default/sa/api, a scheme is required
+func parseURI(value string) (*url.URL, error) {
+	uri, err := url.Parse(value)
+	if err != nil || uri.Scheme == "" {
+		return nil, errors.Errorf("%q is not an absolute URI", value)
+	}
+
+	return uri, nil
+}
+
+// leafTemplate describes a certificate for the task domains and addresses, a TLS server certificate by default
+func leafTemplate(task CertTask, publicKey crypto.PublicKey) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate serial number")
+	}
+
+	ips := make([]net.IP, 0, len(task.IPAddresses))
+	for _, address := range task.IPAddresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, errors.Errorf("invalid IP address %q", address)
+		}
+		ips = append(ips, ip)
+	}
+
+	uris := make([]*url.URL, 0, len(task.URIs))
+	for _, value := range task.URIs {
+		uri, err := parseURI(value)
+		if err != nil {
+			return nil, err
+		}
+		uris = append(uris, uri)
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, isRSA := publicKey.(*rsa.PublicKey); isRSA {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	extKeyUsage := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	if len(task.KeyUsages) > 0 {
+		keyUsage, extKeyUsage = 0, nil
+		for _, usage := range task.KeyUsages {
+			if ku, ok := keyUsages[usage]; ok {
+				keyUsage |= ku
+			} else if eku, ok := extKeyUsages[usage]; ok {
+				extKeyUsage = append(extKeyUsage, eku)
+			} else {
+				return nil, errors.Errorf("unknown key usage %q", usage)
+			}
+		}
+	}
+
+	// backdated to tolerate clock skew of clients
+	now := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: task.Domain},
+		DNSNames:              task.dnsNames(),
+		IPAddresses:           ips,
+		URIs:                  uris,
+		NotBefore:             now,
+		NotAfter:              now.Add(task.validity()),
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           extKeyUsage,
+		BasicConstraintsValid: true,
+	}, nil
+}
@@ -0,0 +1,496 @@
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"net"
+	"net/mail"
+	"path/filepath"
+	"reflect"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	IssuerACME       = "acme"
+	IssuerSelfSigned = "selfsigned"
+	IssuerCA         = "ca"
+)
+
+// keyTypes maps the config key type names to the key types of issued certificates
+var keyTypes = map[string]certcrypto.KeyType{
+	"rsa2048": certcrypto.RSA2048,
+	"rsa3072": certcrypto.RSA3072,
+	"rsa4096": certcrypto.RSA4096,
+	"rsa8192": certcrypto.RSA8192,
+	"ec256":   certcrypto.EC256,
+	"ec384":   certcrypto.EC384,
+}
+
+// issuers lists the supported task issuers
+var issuers = map[string]bool{
+	IssuerACME:       true,
+	IssuerSelfSigned: true,
+	IssuerCA:         true,
+}
+
+// keyUsages maps the config key usage names to the key usages of certificates from local issuers
+var keyUsages = map[string]x509.KeyUsage{
+	"digital signature":  x509.KeyUsageDigitalSignature,
+	"content commitment": x509.KeyUsageContentCommitment,
+	"key encipherment":   x509.KeyUsageKeyEncipherment,
+	"data encipherment":  x509.KeyUsageDataEncipherment,
+	"key agreement":      x509.KeyUsageKeyAgreement,
+}
+
+// extKeyUsages maps the config key usage names to the extended key usages of certificates from local issuers
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"server auth":      x509.ExtKeyUsageServerAuth,
+	"client auth":      x509.ExtKeyUsageClientAuth,
+	"code signing":     x509.ExtKeyUsageCodeSigning,
+	"email protection": x509.ExtKeyUsageEmailProtection,
+	"timestamping":     x509.ExtKeyUsageTimeStamping,
+	"ocsp signing":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// Defaults are inherited by all tasks which don't set the values themselves
+type Defaults struct {
+	Email       string    `json:"Email,omitempty"`
+	Issuer      string    `json:"Issuer,omitempty"`
+	KeyType     string    `json:"KeyType,omitempty"`
+	RenewBefore *Duration `json:"RenewBefore,omitempty"`
+	ACMEIssuer  string    `json:"ACMEIssuer,omitempty"`
+}
+
+// TaskFile is the config file format with defaults, a plain array of tasks is accepted as well
+type TaskFile struct {
+	Defaults *Defaults `json:"Defaults,omitempty"`
+	// ACMEIssuers are ACME CAs shared by the tasks naming them in ACMEIssuer, tasks of an issuer use one account
+	ACMEIssuers map[string]*ACMEConfig `json:"ACMEIssuers,omitempty"`
+	Tasks       []CertTask             `json:"Tasks"`
+}
+
+// ValidationError is a problem of a single task, Index is -1 for problems of the whole file
+type ValidationError struct {
+	Index   int    `json:"index"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	prefix := "config"
+	if e.Index >= 0 {
+		prefix = fmt.Sprintf("task %d", e.Index)
+	}
+	if e.Field != "" {
+		prefix += " " + e.Field
+	}
+
+	return prefix + ": " + e.Message
+}
+
+// ValidationErrors collects all problems found in the config file
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+func (e *ValidationErrors) add(index int, field, format string, args ...interface{}) {
+	*e = append(*e, ValidationError{Index: index, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// ParseTasks decodes a JSON or YAML config file and validates the tasks against the global renewal window,
+// validation problems are returned as ValidationErrors
+func ParseTasks(data []byte, renewBefore time.Duration) ([]CertTask, error) {
+	tasks, err := DecodeTasks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if errs := ValidateTasks(tasks, renewBefore); len(errs) > 0 {
+		return nil, errs
+	}
+
+	return tasks, nil
+}
+
+// DecodeTasks decodes a JSON or YAML config file rejecting unknown fields and applies the defaults to the tasks
+func DecodeTasks(data []byte) ([]CertTask, error) {
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, ValidationErrors{{Index: -1, Message: fmt.Sprintf("invalid YAML or JSON: %v", err)}}
+	}
+
+	file := TaskFile{}
+	if bytes.HasPrefix(bytes.TrimSpace(jsonData), []byte("[")) {
+		err = decodeStrict(jsonData, &file.Tasks)
+	} else {
+		err = decodeStrict(jsonData, &file)
+	}
+	if err != nil {
+		return nil, ValidationErrors{{Index: -1, Message: err.Error()}}
+	}
+
+	file.applyDefaults()
+	if errs := file.resolveACMEIssuers(); len(errs) > 0 {
+		return nil, errs
+	}
+
+	return file.Tasks, nil
+}
+
+// ResolveDomains checks that the task domains resolve in DNS, wildcard domains and local issuers
+// whose names may only exist inside the cluster are skipped
+func ResolveDomains(ctx context.Context, tasks []CertTask) ValidationErrors {
+	errs := ValidationErrors{}
+	for i, task := range tasks {
+		if task.Domain == "" || strings.HasPrefix(task.Domain, "*.") || !task.isACME() {
+			continue
+		}
+
+		lookupCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		_, err := net.DefaultResolver.LookupHost(lookupCtx, task.Domain)
+		cancel()
+		if err != nil {
+			errs.add(i, "Domain", "%s doesn't resolve: %v", task.Domain, err)
+		}
+	}
+
+	return errs
+}
+
+func decodeStrict(data []byte, target interface{}) error {
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return errors.Wrap(err, "failed to decode config")
+	}
+	if err := canonicalKeys(generic, reflect.TypeOf(target), ""); err != nil {
+		return errors.Wrap(err, "failed to decode config")
+	}
+	data, err := json.Marshal(generic)
+	if err != nil {
+		return errors.Wrap(err, "failed to decode config")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(target); err != nil {
+		return errors.Wrap(err, "failed to decode config")
+	}
+	if decoder.More() {
+		return errors.New("unexpected data after the config")
+	}
+
+	return nil
+}
+
+func (f *TaskFile) applyDefaults() {
+	if f.Defaults == nil {
+		return
+	}
+
+	for i := range f.Tasks {
+		task := &f.Tasks[i]
+		if task.Email == "" {
+			task.Email = f.Defaults.Email
+		}
+		if task.Issuer == "" {
+			task.Issuer = f.Defaults.Issuer
+		}
+		if task.KeyType == "" {
+			task.KeyType = f.Defaults.KeyType
+		}
+		if task.RenewBefore == nil {
+			task.RenewBefore = f.Defaults.RenewBefore
+		}
+		if task.ACMEIssuer == "" && task.ACME == nil && task.isACME() {
+			task.ACMEIssuer = f.Defaults.ACMEIssuer
+		}
+	}
+}
+
+// resolveACMEIssuers points the tasks to the shared config of the ACME issuer they name
+func (f *TaskFile) resolveACMEIssuers() ValidationErrors {
+	errs := ValidationErrors{}
+	for i := range f.Tasks {
+		task := &f.Tasks[i]
+		if task.ACMEIssuer == "" {
+			continue
+		}
+
+		acmeCfg, ok := f.ACMEIssuers[task.ACMEIssuer]
+		switch {
+		case !ok || acmeCfg == nil:
+			errs.add(i, "ACMEIssuer", "unknown ACME issuer %q", task.ACMEIssuer)
+		case task.ACME != nil:
+			errs.add(i, "ACME", "must not be set together with ACMEIssuer")
+		default:
+			task.ACME = acmeCfg
+		}
+	}
+
+	return errs
+}
+
+// ValidateTasks checks all tasks and returns every problem found, renewBefore is the global renewal window
+// which certificates of local issuers must outlive
+func ValidateTasks(tasks []CertTask, renewBefore time.Duration) ValidationErrors {
+	errs := ValidationErrors{}
+	for i, task := range tasks {
+		validateTask(i, task, renewBefore, &errs)
+	}
+	validateTargets(tasks, &errs)
+
+	return errs
+}
+
+func validateTask(i int, task CertTask, renewBefore time.Duration, errs *ValidationErrors) {
+	if task.Files != nil {
+		validateFilesTask(i, task, errs)
+	} else {
+		validateSecretTask(i, task, errs)
+	}
+
+	if task.Domain == "" {
+		errs.add(i, "Domain", "must not be empty")
+	} else if msg := validateDomain(task.Domain, task.isACME()); msg != "" {
+		errs.add(i, "Domain", "%s", msg)
+	}
+
+	if task.Email == "" {
+		if task.isACME() {
+			errs.add(i, "Email", "must not be empty")
+		}
+	} else if addr, err := mail.ParseAddress(task.Email); err != nil || addr.Address != task.Email {
+		errs.add(i, "Email", "%q is not a valid email address", task.Email)
+	}
+
+	if task.Issuer != "" && !issuers[task.Issuer] {
+		errs.add(i, "Issuer", "unknown issuer %q, supported: %s", task.Issuer, strings.Join(sortedKeys(issuers), ", "))
+	}
+	if task.KeyType != "" {
+		if _, ok := keyTypes[task.KeyType]; !ok {
+			errs.add(i, "KeyType", "unknown key type %q, supported: %s", task.KeyType, strings.Join(sortedKeys(keyTypes), ", "))
+		}
+	}
+	if task.RenewBefore != nil && task.RenewBefore.Duration <= 0 {
+		errs.add(i, "RenewBefore", "must be positive")
+	}
+	validateLocalIssuer(i, task, renewBefore, errs)
+
+	if task.ACME != nil {
+		if err := task.ACME.Validate(); err != nil {
+			errs.add(i, "ACME", "%v", err)
+		}
+	}
+}
+
+// validateLocalIssuer checks the certificate fields of issuers which sign certificates themselves
+func validateLocalIssuer(i int, task CertTask, renewBefore time.Duration, errs *ValidationErrors) {
+	if task.isACME() {
+		fields := map[string]bool{
+			"DNSNames":    len(task.DNSNames) > 0,
+			"IPAddresses": len(task.IPAddresses) > 0,
+			"URIs":        len(task.URIs) > 0,
+			"Validity":    task.Validity != nil,
+			"KeyUsages":   len(task.KeyUsages) > 0,
+			"CA":          task.CA != nil,
+		}
+		for _, field := range sortedKeys(fields) {
+			if fields[field] {
+				errs.add(i, field, "is not supported by the acme issuer")
+			}
+		}
+		return
+	}
+
+	if task.Issuer == IssuerCA {
+		if task.CA == nil {
+			errs.add(i, "CA", "must be set for the ca issuer")
+		} else if err := task.CA.Validate(); err != nil {
+			errs.add(i, "CA", "%v", err)
+		}
+	} else if task.CA != nil {
+		errs.add(i, "CA", "is only used by the ca issuer")
+	}
+
+	for _, name := range task.DNSNames {
+		if msg := validateDomain(name, false); msg != "" {
+			errs.add(i, "DNSNames", "%s", msg)
+		}
+	}
+	for _, address := range task.IPAddresses {
+		if net.ParseIP(address) == nil {
+			errs.add(i, "IPAddresses", "%q is not an IP address", address)
+		}
+	}
+	for _, uri := range task.URIs {
+		if _, err := parseURI(uri); err != nil {
+			errs.add(i, "URIs", "%v", err)
+		}
+	}
+	for _, usage := range task.KeyUsages {
+		_, isKeyUsage := keyUsages[usage]
+		_, isExtKeyUsage := extKeyUsages[usage]
+		if !isKeyUsage && !isExtKeyUsage {
+			errs.add(i, "KeyUsages", "unknown key usage %q, supported: %s", usage, strings.Join(append(sortedKeys(keyUsages), sortedKeys(extKeyUsages)...), ", "))
+		}
+	}
+	// certificates which don't outlive the renewal window would be reissued on every run
+	if task.Validity != nil && task.Validity.Duration <= 0 {
+		errs.add(i, "Validity", "must be positive")
+	} else if window := task.renewBefore(renewBefore); task.validity() <= window {
+		errs.add(i, "Validity", "%s must be longer than the renewal window %s", task.validity(), window)
+	}
+}
+
+func validateSecretTask(i int, task CertTask, errs *ValidationErrors) {
+	if task.Namespace == "" {
+		errs.add(i, "Namespace", "must not be empty")
+	} else {
+		for _, msg := range validation.IsDNS1123Label(task.Namespace) {
+			errs.add(i, "Namespace", "%s", msg)
+		}
+	}
+
+	if task.Secret == "" {
+		errs.add(i, "Secret", "must not be empty")
+	} else {
+		for _, msg := range validation.IsDNS1123Subdomain(task.Secret) {
+			errs.add(i, "Secret", "%s", msg)
+		}
+	}
+
+	for _, namespace := range task.Namespaces {
+		for _, msg := range validation.IsDNS1123Label(namespace) {
+			errs.add(i, "Namespaces", "%s: %s", namespace, msg)
+		}
+	}
+	if task.NamespaceSelector != "" {
+		if _, err := labels.Parse(task.NamespaceSelector); err != nil {
+			errs.add(i, "NamespaceSelector", "%v", err)
+		}
+	}
+	if task.Outputs != nil {
+		if err := task.Outputs.Validate(); err != nil {
+			errs.add(i, "Outputs", "%v", err)
+		}
+	}
+	if task.Rollout != nil {
+		if err := task.Rollout.Validate(); err != nil {
+			errs.add(i, "Rollout", "%v", err)
+		}
+	}
+}
+
+// validateFilesTask rejects the secret related fields of tasks writing certificate files
+func validateFilesTask(i int, task CertTask, errs *ValidationErrors) {
+	if err := task.Files.Validate(); err != nil {
+		errs.add(i, "Files", "%v", err)
+	}
+
+	fields := map[string]bool{
+		"Namespace":         task.Namespace != "",
+		"Secret":            task.Secret != "",
+		"Namespaces":        len(task.Namespaces) > 0,
+		"NamespaceSelector": task.NamespaceSelector != "",
+		"Outputs":           task.Outputs != nil,
+		"Rollout":           task.Rollout != nil,
+	}
+	for _, field := range sortedKeys(fields) {
+		if fields[field] {
+			errs.add(i, field, "can't be used together with Files")
+		}
+	}
+}
+
+// validateDomain checks the DNS name syntax, a leading wildcard label is allowed, public CAs only
+// issue certificates for fully qualified names while local issuers accept names like localhost
+func validateDomain(domain string, requireFQDN bool) string {
+	if domain != strings.ToLower(domain) {
+		return fmt.Sprintf("%q must be lower case", domain)
+	}
+
+	var msgs []string
+	if strings.HasPrefix(domain, "*.") {
+		msgs = validation.IsWildcardDNS1123Subdomain(domain)
+	} else {
+		msgs = validation.IsDNS1123Subdomain(domain)
+	}
+	if len(msgs) > 0 {
+		return fmt.Sprintf("%q is not a valid DNS name: %s", domain, strings.Join(msgs, ", "))
+	}
+	if requireFQDN && !strings.Contains(domain, ".") {
+		return fmt.Sprintf("%q is not a fully qualified domain name", domain)
+	}
+
+	return ""
+}
+
+// validateTargets reports secrets and files written by more than one task, including replica copies
+func validateTargets(tasks []CertTask, errs *ValidationErrors) {
+	owners := map[string]int{}
+	fileOwners := map[string]int{}
+	for i, task := range tasks {
+		if task.Files != nil {
+			for _, path := range []string{task.Files.Cert, task.Files.Key, task.Files.Chain, task.Files.Fullchain} {
+				if path == "" {
+					continue
+				}
+				path = filepath.Clean(path)
+				if owner, ok := fileOwners[path]; ok && owner != i {
+					errs.add(i, "Files", "file %s is also written by task %d", path, owner)
+					continue
+				}
+				fileOwners[path] = i
+			}
+			continue
+		}
+
+		targets := append([]string{task.Namespace}, task.Namespaces...)
+		for _, namespace := range targets {
+			key := namespace + "/" + task.Secret
+			owner, ok := owners[key]
+			if !ok {
+				owners[key] = i
+				continue
+			}
+			if owner == i {
+				errs.add(i, "Namespaces", "secret %s is listed twice", key)
+				continue
+			}
+
+			other := tasks[owner]
+			if other.Namespace == task.Namespace && other.Domain == task.Domain && namespace == task.Namespace {
+				errs.add(i, "Secret", "duplicates task %d", owner)
+			} else {
+				errs.add(i, "Secret", "secret %s is also written by task %d", key, owner)
+			}
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -4,11 +4,31 @@ import (
 	"github.com/kelseyhightower/envconfig"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"net/url"
+	"time"
 )
 
 type Config struct {
-	Port          int    `envconfig:"PORT" default:"8080"`
-	ChallengePath string `envconfig:"PATH" required:"true"`
+	Port int `envconfig:"PORT" default:"8080"`
+	// ChallengePath is the directory shared with the certmanager, it's not used when both run in one process
+	ChallengePath string `envconfig:"PATH"`
+	// Upstreams are base URLs of other challenge servers asked for tokens which are unknown locally
+	Upstreams       []string      `envconfig:"UPSTREAMS"`
+	UpstreamTimeout time.Duration `envconfig:"UPSTREAM_TIMEOUT" default:"5s"`
+}
+
+func (c *Config) validate() error {
+	for _, upstream := range c.Upstreams {
+		u, err := url.Parse(upstream)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("invalid upstream %q, expected an http or https URL", upstream)
+		}
+	}
+	if len(c.Upstreams) > 0 && c.UpstreamTimeout <= 0 {
+		return errors.New("upstream timeout must be positive")
+	}
+
+	return nil
 }
 
 func LoadConfig() (cfg *Config, err error) {
@@ -18,6 +38,11 @@ func LoadConfig() (cfg *Config, err error) {
 		return nil, errors.Wrap(err, "failed to load config")
 	}
 
+	err = cfg.validate()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid challenge config")
+	}
+
 	logrus.Infof("loaded challenge config: %+v", cfg)
 
 	return cfg, nil
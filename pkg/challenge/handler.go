@@ -1,80 +1,89 @@
 package challenge
 
 import (
-	"github.com/sirupsen/logrus"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/breathbath/certmanager/pkg/tracing"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
 	"net/http"
-	"os"
-	"path"
+	"regexp"
 	"strings"
 )
 
+// validToken matches the base64url alphabet of ACME tokens, anything else can't be a token and is rejected before the lookup
+var validToken = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
 type Handler struct {
-	cfg *Config
+	tokens TokenStore
+	// proxy forwards tokens which are not in the store, it's nil if no upstreams are configured
+	proxy *Proxy
 }
 
-func NewHandler(cfg *Config) *Handler {
+func NewHandler(tokens TokenStore, proxy *Proxy) *Handler {
 	return &Handler{
-		cfg: cfg,
+		tokens: tokens,
+		proxy:  proxy,
 	}
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	logrus.Infof("Received request: %s %s", r.Method, r.URL.Path)
+	// requests from the certmanager self-check carry its trace context
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracing.Start(ctx, "challenge.request", attribute.String("http.path", r.URL.Path))
+	defer span.End()
+	log := logging.FromContext(ctx)
+
+	log.Infof("Received request: %s %s", r.Method, r.URL.Path)
 
 	prefix := "/.well-known/acme-challenge/"
 	if !strings.HasPrefix(r.URL.Path, prefix) {
-		logrus.Errorf("Invalid request path, does not match prefix: %s", r.URL.Path)
+		log.Errorf("Invalid request path, does not match prefix: %s", r.URL.Path)
 		http.NotFound(w, r)
 		return
 	}
 
-	logrus.Debugf("Request passed prefix validation: %s", r.URL.Path)
+	log.Debugf("Request passed prefix validation: %s", r.URL.Path)
 
 	token := strings.TrimPrefix(r.URL.Path, prefix)
 	if token == "" {
-		logrus.Errorf("Token is missing from path: %s", r.URL.Path)
+		log.Errorf("Token is missing from path: %s", r.URL.Path)
 		http.NotFound(w, r)
 		return
 	}
-	logrus.Infof("Token extracted from request path: %s", token)
+	log.Infof("Token extracted from request path: %s", token)
 
-	files, err := os.ReadDir(h.cfg.ChallengePath)
-	if err != nil {
-		logrus.Errorf("Failed to read challenge directory '%s': %s", h.cfg.ChallengePath, err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	if !validToken.MatchString(token) {
+		log.Errorf("Invalid token in request path: %s", r.URL.Path)
+		http.NotFound(w, r)
 		return
 	}
 
-	var matchedFile string
-	for _, f := range files {
-		logrus.Debugf("Checking file: %s", f.Name())
-		if !f.IsDir() && f.Name() == token {
-			matchedFile = f.Name()
-			logrus.Infof("Matching challenge file found: %s", matchedFile)
-			break
-		}
+	data, err := h.tokens.Get(token)
+	if errors.Is(err, ErrTokenNotFound) && h.proxy != nil && r.Header.Get(proxiedHeader) == "" {
+		log.Infof("Token %s is unknown, asking upstream challenge servers", token)
+		data, err = h.proxy.Fetch(ctx, token)
 	}
-	if matchedFile == "" {
-		logrus.Errorf("Challenge file not found for token: %s", token)
+	if errors.Is(err, ErrTokenNotFound) {
+		log.Errorf("Challenge not found for token %s: %v", token, err)
 		http.NotFound(w, r)
 		return
 	}
-
-	data, err := os.ReadFile(path.Join(h.cfg.ChallengePath, matchedFile))
 	if err != nil {
-		logrus.Errorf("Failed to read challenge file '%s': %s", matchedFile, err)
-		http.NotFound(w, r)
+		log.Errorf("Failed to read challenge for token %s: %s", token, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	logrus.Infof("Successfully read challenge file: %s", matchedFile)
+	log.Infof("Found challenge for token: %s", token)
 
 	w.Header().Set("Content-Type", "text/plain")
 
 	_, err = w.Write(data)
 	if err != nil {
-		logrus.Errorf("Failed to write challenge response: %s", err)
+		log.Errorf("Failed to write challenge response: %s", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	logrus.Infof("Successfully served challenge response for token: %s", token)
+	log.Infof("Successfully served challenge response for token: %s", token)
 }
@@ -0,0 +1,112 @@
+package challenge
+
+import (
+	"bytes"
+	"context"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// proxiedHeader marks forwarded requests, they are answered from the local store only to avoid forwarding loops
+	proxiedHeader = "X-Certmanager-Proxied"
+	// maxAnswerSize limits the read upstream answer, key authorizations are well below it
+	maxAnswerSize = 4096
+)
+
+// Proxy asks upstream challenge servers for tokens which are unknown locally
+type Proxy struct {
+	upstreams []string
+	timeout   time.Duration
+	client    *http.Client
+}
+
+func NewProxy(upstreams []string, timeout time.Duration) *Proxy {
+	return &Proxy{
+		upstreams: upstreams,
+		timeout:   timeout,
+		client: &http.Client{
+			Timeout: timeout,
+			// a redirect is not an answer, the upstream has to serve the token itself
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+type upstreamAnswer struct {
+	upstream string
+	keyAuth  []byte
+	err      error
+}
+
+// Fetch asks all upstreams at once and returns the first valid key authorization
+func (p *Proxy) Fetch(ctx context.Context, token string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	answers := make(chan upstreamAnswer, len(p.upstreams))
+	for _, upstream := range p.upstreams {
+		go func(upstream string) {
+			keyAuth, err := p.fetch(ctx, upstream, token)
+			answers <- upstreamAnswer{upstream: upstream, keyAuth: keyAuth, err: err}
+		}(upstream)
+	}
+
+	log := logging.FromContext(ctx)
+	failures := make([]string, 0, len(p.upstreams))
+	for range p.upstreams {
+		answer := <-answers
+		if answer.err == nil {
+			log.Infof("Upstream %s answered challenge for token: %s", answer.upstream, token)
+			return answer.keyAuth, nil
+		}
+		log.Debugf("Upstream %s has no challenge for token %s: %v", answer.upstream, token, answer.err)
+		failures = append(failures, answer.upstream+": "+answer.err.Error())
+	}
+
+	return nil, errors.Wrapf(ErrTokenNotFound, "no upstream answered (%s)", strings.Join(failures, "; "))
+}
+
+func (p *Proxy) fetch(ctx context.Context, upstream, token string) ([]byte, error) {
+	url := strings.TrimRight(upstream, "/") + "/.well-known/acme-challenge/" + token
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create upstream request")
+	}
+	req.Header.Set(proxiedHeader, "1")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxAnswerSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read answer")
+	}
+	if len(body) > maxAnswerSize {
+		return nil, errors.New("answer is too large")
+	}
+
+	// key authorizations are the token followed by the account key thumbprint
+	keyAuth := bytes.TrimSpace(body)
+	if !bytes.HasPrefix(keyAuth, []byte(token+".")) {
+		return nil, errors.New("answer is not a key authorization of the token")
+	}
+
+	return keyAuth, nil
+}
@@ -3,47 +3,82 @@ package challenge
 import (
 	"context"
 	"fmt"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"net/http"
 	"time"
 )
 
+// Start serves challenges from the configured directory until the context is done
 func Start(ctx context.Context) error {
-	mux := http.NewServeMux()
-
 	cfg, err := LoadConfig()
 	if err != nil {
 		return err
 	}
+	if cfg.ChallengePath == "" {
+		return errors.New("CHALLENGE_PATH must be set")
+	}
 
-	challengeHandler := NewHandler(cfg)
-	mux.Handle("/.well-known/acme-challenge/", challengeHandler)
+	return NewServer(cfg, NewDirStore(cfg.ChallengePath)).Run(ctx)
+}
 
-	addr := fmt.Sprintf(":%d", cfg.Port)
+// Server answers HTTP-01 challenges with the key authorizations from the token store
+type Server struct {
+	srv *http.Server
+}
 
-	srv := &http.Server{
-		Addr:    addr,
-		Handler: mux,
+// NewServer creates a challenge server, tokens unknown to the store are forwarded to the configured upstreams
+func NewServer(cfg *Config, tokens TokenStore) *Server {
+	var proxy *Proxy
+	if len(cfg.Upstreams) > 0 {
+		proxy = NewProxy(cfg.Upstreams, cfg.UpstreamTimeout)
 	}
 
-	// Run server in a goroutine
-	go func() {
-		logrus.Infof("Starting HTTP server on %s", addr)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logrus.Fatalf("HTTP server error: %v", err)
-		}
-	}()
+	mux := http.NewServeMux()
+	mux.Handle("/.well-known/acme-challenge/", NewHandler(tokens, proxy))
+
+	return &Server{
+		srv: &http.Server{
+			Addr:              fmt.Sprintf(":%d", cfg.Port),
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+}
 
-	<-ctx.Done()
+// ListenAndServe blocks until the server fails or is shut down
+func (s *Server) ListenAndServe() error {
+	logrus.Infof("Starting HTTP server on %s", s.srv.Addr)
+	err := s.srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		return errors.Wrap(err, "HTTP server error")
+	}
+
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for the running requests
+func (s *Server) Shutdown(ctx context.Context) error {
 	logrus.Info("Shutting down HTTP server...")
 
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
 
-	err = srv.Shutdown(shutdownCtx)
-	if err != nil {
+// Run serves until the context is done and shuts the server down gracefully afterwards
+func (s *Server) Run(ctx context.Context) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
 		return err
+	case <-ctx.Done():
 	}
 
-	return nil
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return s.Shutdown(shutdownCtx)
 }
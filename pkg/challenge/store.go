@@ -0,0 +1,95 @@
+package challenge
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"path"
+	"sync"
+)
+
+// ErrTokenNotFound is returned by token stores for unknown tokens
+var ErrTokenNotFound = errors.New("challenge token not found")
+
+// TokenStore keeps the key authorizations of the pending HTTP-01 challenges
+type TokenStore interface {
+	Put(token, keyAuth string) error
+	Get(token string) ([]byte, error)
+	Delete(token string) error
+}
+
+// DirStore keeps tokens as files in a directory shared by the certmanager and challenge server containers
+type DirStore struct {
+	dir string
+}
+
+func NewDirStore(dir string) *DirStore {
+	return &DirStore{dir: dir}
+}
+
+func (s *DirStore) Put(token, keyAuth string) error {
+	err := os.WriteFile(path.Join(s.dir, token), []byte(keyAuth), 0644)
+	if err != nil {
+		return errors.Wrap(err, "Failed to write challenge file")
+	}
+
+	return nil
+}
+
+func (s *DirStore) Get(token string) ([]byte, error) {
+	data, err := os.ReadFile(path.Join(s.dir, token))
+	if os.IsNotExist(err) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read challenge file %s", token)
+	}
+
+	return data, nil
+}
+
+func (s *DirStore) Delete(token string) error {
+	err := os.Remove(path.Join(s.dir, token))
+	if err != nil {
+		return errors.Wrap(err, "Failed to remove challenge file")
+	}
+
+	return nil
+}
+
+// MemoryStore keeps tokens in memory for challenge servers running in the certmanager process
+type MemoryStore struct {
+	mu     sync.RWMutex
+	tokens map[string]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tokens: map[string]string{}}
+}
+
+func (s *MemoryStore) Put(token, keyAuth string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token] = keyAuth
+
+	return nil
+}
+
+func (s *MemoryStore) Get(token string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keyAuth, ok := s.tokens[token]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+
+	return []byte(keyAuth), nil
+}
+
+func (s *MemoryStore) Delete(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, token)
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"github.com/breathbath/certmanager/pkg/certmanager"
+	"github.com/breathbath/certmanager/pkg/challenge"
+	"github.com/breathbath/certmanager/pkg/metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var allShutdownTimeout time.Duration
+
+var allCmd = &cobra.Command{
+	Use:   "all",
+	Short: "Starts the challenge server and the certmanager in one process sharing challenge tokens in memory",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		stopTracing, err := startTracing("certmanager")
+		if err != nil {
+			return err
+		}
+		defer stopTracing()
+
+		challengeCfg, err := challenge.LoadConfig()
+		if err != nil {
+			return err
+		}
+
+		cm, err := certmanager.NewCertManager()
+		if err != nil {
+			return err
+		}
+
+		metricsCfg, err := metrics.LoadConfig()
+		if err != nil {
+			return err
+		}
+
+		tokens := challenge.NewMemoryStore()
+		cm.SetTokenStore(tokens)
+
+		server := challenge.NewServer(challengeCfg, tokens)
+		serverErr := make(chan error, 1)
+		go func() {
+			serverErr <- server.ListenAndServe()
+		}()
+
+		// the manager gets its own context, so it can be stopped before the challenge server
+		managerCtx, stopManager := context.WithCancel(context.Background())
+		defer stopManager()
+		metricsCtx, stopMetrics := context.WithCancel(context.Background())
+		defer stopMetrics()
+
+		manager := &sync.WaitGroup{}
+		manager.Add(2)
+		go func() {
+			defer manager.Done()
+			cm.ScanPeriodically(managerCtx)
+		}()
+		go func() {
+			defer manager.Done()
+			cm.RunPeriodically(managerCtx)
+		}()
+
+		metricsDone := make(chan struct{})
+		go func() {
+			defer close(metricsDone)
+			metrics.Serve(metricsCtx, metricsCfg)
+		}()
+
+		select {
+		case <-ctx.Done():
+			logrus.Info("Received shutdown signal, shutting down...")
+			err = nil
+		case err = <-serverErr:
+			logrus.Errorf("Challenge server stopped: %v", err)
+		}
+
+		// a running certificate check may still need the challenge server to answer its orders
+		stopManager()
+		if !waitFor(manager, allShutdownTimeout) {
+			logrus.Warnf("Certificate checks didn't finish within %s, stopping anyway", allShutdownTimeout)
+		} else {
+			logrus.Info("Certificate checks stopped")
+		}
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if shutdownErr := server.Shutdown(shutdownCtx); shutdownErr != nil {
+			logrus.Errorf("Failed to shut down challenge server: %v", shutdownErr)
+		}
+
+		stopMetrics()
+		<-metricsDone
+
+		return err
+	},
+}
+
+// waitFor waits for the group until the timeout, false is returned if the group is still running
+func waitFor(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func initAllCmd() {
+	allCmd.Flags().DurationVar(&allShutdownTimeout, "shutdown-timeout", 25*time.Second, "time given to running certificate checks to finish on shutdown")
+	RootCmd.AddCommand(allCmd)
+}
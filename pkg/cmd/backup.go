@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/breathbath/certmanager/pkg/backup"
+	"github.com/breathbath/certmanager/pkg/certmanager"
+	"github.com/breathbath/certmanager/pkg/k8s"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+var backupPath string
+var backupSecret string
+var backupFile string
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Lists and restores certificate backups",
+}
+
+var backupListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists certificate backups with their expiry",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := loadBackupStore()
+		if err != nil {
+			return err
+		}
+
+		var backups []*backup.Backup
+		if backupSecret != "" {
+			namespace, name, err := certmanager.ParseSecretRef(backupSecret)
+			if err != nil {
+				return err
+			}
+			backups, err = store.Find(namespace, name)
+			if err != nil {
+				return err
+			}
+		} else {
+			backups, err = store.List()
+			if err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "FILE\tSECRET\tCREATED\tNOT AFTER\tSTATUS")
+		for _, b := range backups {
+			secret, notAfter, status := "-", "-", "valid"
+			if b.Secret != nil {
+				secret = b.Namespace() + "/" + b.SecretName()
+			}
+			if b.Cert != nil {
+				notAfter = b.Cert.NotAfter.UTC().Format(time.RFC3339)
+			}
+			if err := b.Verify(now); err != nil {
+				status = err.Error()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", b.Path, secret, b.CreatedAt.UTC().Format(time.RFC3339), notAfter, status)
+		}
+
+		return w.Flush()
+	},
+}
+
+var backupHistoryCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Lists archived certificate versions of a secret",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if backupSecret == "" {
+			return errors.New("secret must be set")
+		}
+
+		namespace, name, err := certmanager.ParseSecretRef(backupSecret)
+		if err != nil {
+			return err
+		}
+
+		store, err := loadBackupStore()
+		if err != nil {
+			return err
+		}
+
+		versions, err := store.History(namespace, name)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "FILE\tSERIAL\tSHA256 FINGERPRINT\tNOT AFTER\tCERT URL")
+		for _, b := range versions {
+			if b.Err != nil {
+				fmt.Fprintf(w, "%s\t-\t-\t-\t%s\n", b.Path, b.Err)
+				continue
+			}
+			v := backup.VersionOf(b)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", b.Path, v.Serial, v.Fingerprint, v.NotAfter.Format(time.RFC3339), v.CertURL)
+		}
+
+		return w.Flush()
+	},
+}
+
+var backupRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Applies the newest valid backup of a secret or the given backup file to the cluster",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if backupSecret == "" && backupFile == "" {
+			return errors.New("one of secret or file must be set")
+		}
+
+		store, err := loadBackupStore()
+		if err != nil {
+			return err
+		}
+
+		b, err := pickBackup(store)
+		if err != nil {
+			return err
+		}
+
+		clientset, err := k8s.NewClient()
+		if err != nil {
+			return errors.Wrap(err, "Failed to create Kubernetes client")
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		sm := k8s.NewSecretManager(clientset, nil, dryRun)
+		err = sm.RestoreBackup(ctx, b)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stdout, "%srestored %s/%s from %s, certificate expires at %s\n", resultPrefix(),
+			b.Namespace(), b.SecretName(), b.Path, b.Cert.NotAfter.UTC().Format(time.RFC3339))
+
+		return nil
+	},
+}
+
+func loadBackupStore() (*backup.Store, error) {
+	cfg, err := backup.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if backupPath != "" {
+		cfg.BackupPath = backupPath
+	}
+
+	if strings.TrimSpace(cfg.BackupPath) == "" {
+		return nil, errors.New("backup path is not set, use --path or CERTMANAGER_BACKUP_PATH")
+	}
+
+	return backup.NewStore(cfg)
+}
+
+func pickBackup(store *backup.Store) (*backup.Backup, error) {
+	if backupFile != "" {
+		return pickBackupFile(store, backupFile, backupSecret)
+	}
+
+	namespace, name, err := certmanager.ParseSecretRef(backupSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	backups, err := store.Find(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, b := range backups {
+		if err := b.Verify(now); err != nil {
+			logrus.Warnf("skipping backup: %v", err)
+			continue
+		}
+		return b, nil
+	}
+
+	return nil, errors.Errorf("no valid backup found for secret %s", backupSecret)
+}
+
+// pickBackupFile loads the backup file checking it belongs to the secret if it's given
+func pickBackupFile(store *backup.Store, file, secretRef string) (*backup.Backup, error) {
+	b := store.Load(file)
+	if b.Err != nil {
+		return nil, b.Err
+	}
+	if secretRef != "" && secretRef != b.Namespace()+"/"+b.SecretName() {
+		return nil, errors.Errorf("backup %s belongs to secret %s/%s, not %s", b.Path, b.Namespace(), b.SecretName(), secretRef)
+	}
+
+	return b, nil
+}
+
+func initBackupCmd() {
+	backupCmd.PersistentFlags().StringVar(&backupPath, "path", "", "backup directory, defaults to CERTMANAGER_BACKUP_PATH")
+	backupCmd.PersistentFlags().StringVar(&backupSecret, "secret", "", "secret in namespace/name form")
+	backupRestoreCmd.Flags().StringVar(&backupFile, "file", "", "backup or history file to restore instead of the newest valid backup")
+
+	backupCmd.AddCommand(backupListCmd)
+	backupCmd.AddCommand(backupHistoryCmd)
+	backupCmd.AddCommand(backupRestoreCmd)
+	RootCmd.AddCommand(backupCmd)
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"context"
 	"github.com/breathbath/certmanager/pkg/certmanager"
+	"github.com/breathbath/certmanager/pkg/metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"os"
@@ -20,11 +21,24 @@ var certManagerCmd = &cobra.Command{
 		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
+		stopTracing, err := startTracing("certmanager")
+		if err != nil {
+			return err
+		}
+		defer stopTracing()
+
 		cm, err := certmanager.NewCertManager()
 		if err != nil {
 			return err
 		}
 
+		metricsCfg, err := metrics.LoadConfig()
+		if err != nil {
+			return err
+		}
+
+		go metrics.Serve(ctx, metricsCfg)
+		go cm.ScanPeriodically(ctx)
 		go cm.RunPeriodically(ctx)
 
 		sig := <-sigs
@@ -3,9 +3,7 @@ package cmd
 import (
 	"context"
 	"github.com/breathbath/certmanager/pkg/challenge"
-	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"os"
 	"os/signal"
 	"syscall"
 )
@@ -14,21 +12,16 @@ var challengeCmd = &cobra.Command{
 	Use:   "challenge",
 	Short: "Starts a challenge server",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		ctx, cancel := context.WithCancel(context.Background())
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 		defer cancel()
 
-		sigs := make(chan os.Signal, 1)
-		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-
-		err := challenge.Start(ctx)
+		stopTracing, err := startTracing("certmanager-challenge")
 		if err != nil {
 			return err
 		}
+		defer stopTracing()
 
-		sig := <-sigs
-		logrus.Infof("Received signal %s, shutting down...", sig)
-
-		return nil
+		return challenge.Start(ctx)
 	},
 }
 
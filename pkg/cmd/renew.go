@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/breathbath/certmanager/pkg/certmanager"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var renewFilter certmanager.RenewFilter
+
+var renewCmd = &cobra.Command{
+	Use:   "renew",
+	Short: "Reissues selected certificates immediately ignoring their validity",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := renewFilter.Validate(); err != nil {
+			return err
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		stopTracing, err := startTracing("certmanager")
+		if err != nil {
+			return err
+		}
+		defer stopTracing()
+
+		cm, err := certmanager.NewCertManager()
+		if err != nil {
+			return err
+		}
+
+		results, err := cm.Renew(ctx, renewFilter)
+		if err != nil {
+			return err
+		}
+
+		failed := 0
+		for _, res := range results {
+			fmt.Fprintln(os.Stdout, res.String())
+			if res.Status == certmanager.RenewStatusFailed {
+				failed++
+			}
+		}
+
+		if failed > 0 {
+			return errors.Errorf("%d of %d renewals failed", failed, len(results))
+		}
+
+		return nil
+	},
+}
+
+func initRenewCmd() {
+	renewCmd.Flags().StringSliceVar(&renewFilter.Secrets, "secret", nil, "secret to renew in namespace/name form, can be repeated")
+	renewCmd.Flags().StringSliceVar(&renewFilter.Domains, "domain", nil, "domain to renew, can be repeated")
+	renewCmd.Flags().BoolVar(&renewFilter.All, "all", false, "renew all configured certificates")
+	RootCmd.AddCommand(renewCmd)
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/breathbath/certmanager/pkg/certmanager"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+var revokeSecret string
+var revokeReason string
+var revokeFile string
+var revokeReissue bool
+
+var revokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Revokes a certificate stored in a secret or in a backup file",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if revokeSecret == "" {
+			return errors.New("secret must be set")
+		}
+
+		namespace, name, err := certmanager.ParseSecretRef(revokeSecret)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		stopTracing, err := startTracing("certmanager")
+		if err != nil {
+			return err
+		}
+		defer stopTracing()
+
+		cm, err := certmanager.NewCertManager()
+		if err != nil {
+			return err
+		}
+
+		task, isManaged := cm.FindTask(namespace, name)
+		if revokeReissue && !isManaged {
+			return errors.Errorf("secret %s is not managed by certmanager, cannot reissue it", revokeSecret)
+		}
+
+		if revokeFile != "" {
+			store, err := loadBackupStore()
+			if err != nil {
+				return err
+			}
+			b, err := pickBackupFile(store, revokeFile, revokeSecret)
+			if err != nil {
+				return err
+			}
+			err = cm.Revoke(task.ACME, b.Secret.Data["tls.crt"], b.Secret.Data["tls.key"], revokeReason)
+			if err != nil {
+				return err
+			}
+		} else {
+			err = cm.RevokeSecret(ctx, task.ACME, namespace, name, revokeReason)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(os.Stdout, "%srevoked certificate of %s with reason %s\n", resultPrefix(), revokeSecret, revokeReason)
+
+		if !revokeReissue {
+			return nil
+		}
+
+		err = cm.Reissue(ctx, task)
+		if err != nil {
+			return errors.Wrapf(err, "certificate was revoked but reissue of %s failed", revokeSecret)
+		}
+		fmt.Fprintf(os.Stdout, "%sreissued certificate of %s\n", resultPrefix(), revokeSecret)
+
+		return nil
+	},
+}
+
+func initRevokeCmd() {
+	revokeCmd.Flags().StringVar(&revokeSecret, "secret", "", "secret in namespace/name form")
+	revokeCmd.Flags().StringVar(&revokeReason, "reason", "unspecified", "revocation reason, one of "+strings.Join(certmanager.RevocationReasons(), ", "))
+	revokeCmd.Flags().StringVar(&revokeFile, "file", "", "revoke the certificate from the backup file instead of the secret")
+	revokeCmd.Flags().BoolVar(&revokeReissue, "reissue", false, "issue a replacement certificate right away")
+	RootCmd.AddCommand(revokeCmd)
+}
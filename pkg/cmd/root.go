@@ -1,17 +1,57 @@
 package cmd
 
 import (
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"os"
+	"strconv"
 )
 
+const dryRunEnv = "CERTMANAGER_DRY_RUN"
+
+// dryRun is set by the --dry-run flag or the CERTMANAGER_DRY_RUN variable
+var dryRun bool
+
 var RootCmd = &cobra.Command{
 	Use:   "certmanager",
 	Short: "Root Command for certmanager",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if dryRun {
+			// the certmanager config is read from the environment
+			return os.Setenv(dryRunEnv, "true")
+		}
+
+		if value := os.Getenv(dryRunEnv); value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.Wrapf(err, "invalid %s value %q", dryRunEnv, value)
+			}
+			dryRun = parsed
+		}
+
+		return nil
+	},
+}
+
+// resultPrefix marks command output describing changes which were only planned
+func resultPrefix() string {
+	if dryRun {
+		return "dry run, not applied: "
+	}
+
+	return ""
 }
 
 func Execute() error {
+	RootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "read secrets and plan renewals without writing secrets or ordering from the configured CA")
+	initAllCmd()
 	initCertManagerCmd()
 	initChallengeCmd()
+	initRenewCmd()
+	initBackupCmd()
+	initRevokeCmd()
+	initScanCmd()
+	initValidateCmd()
 	initVersionCmd()
 	return RootCmd.Execute()
 }
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/breathbath/certmanager/pkg/certmanager"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+var scanNamespaces []string
+
+var scanCmd = &cobra.Command{
+	Use:   "scan",
+	Short: "Reports expiry of all TLS secrets in the cluster without modifying them",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		cm, err := certmanager.NewCertManager()
+		if err != nil {
+			return err
+		}
+
+		results, err := cm.Scan(ctx, scanNamespaces)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SECRET\tDOMAIN\tMANAGED\tNOT AFTER\tSTATUS")
+		for _, res := range results {
+			notAfter, status := "-", "valid"
+			switch {
+			case res.Err != nil:
+				status = res.Err.Error()
+			case res.Expiring:
+				status = "expiring"
+			}
+			if !res.NotAfter.IsZero() {
+				notAfter = res.NotAfter.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s/%s\t%s\t%v\t%s\t%s\n", res.Namespace, res.Secret, res.Domain, res.Managed, notAfter, status)
+		}
+
+		return w.Flush()
+	},
+}
+
+func initScanCmd() {
+	scanCmd.Flags().StringSliceVar(&scanNamespaces, "namespace", nil, "namespace to scan, can be repeated, all namespaces are scanned by default")
+	RootCmd.AddCommand(scanCmd)
+}
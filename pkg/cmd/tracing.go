@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"context"
+	"github.com/breathbath/certmanager/pkg/tracing"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// startTracing sets up span export for the command, the returned function flushes the remaining spans
+func startTracing(serviceName string) (func(), error) {
+	shutdown, err := tracing.Init(context.Background(), serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := shutdown(ctx); err != nil {
+			logrus.Warnf("failed to flush traces: %v", err)
+		}
+	}, nil
+}
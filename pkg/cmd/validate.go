@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/breathbath/certmanager/pkg/certmanager"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	validateResolve     bool
+	validateFormat      string
+	validateRenewBefore time.Duration
+)
+
+// ErrInvalidConfig is returned by the validate command for configs with problems, the process exits with code 1 then
+var ErrInvalidConfig = errors.New("invalid config")
+
+type validationReport struct {
+	File   string                       `json:"file"`
+	Valid  bool                         `json:"valid"`
+	Tasks  int                          `json:"tasks"`
+	Errors certmanager.ValidationErrors `json:"errors"`
+}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate <file>",
+	Short: "Validates a config file offline and exits with a non-zero code if it's invalid",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if validateFormat != "json" && validateFormat != "text" {
+			return errors.Errorf("unknown format %q, expected json or text", validateFormat)
+		}
+
+		// the deployment sets the global renewal window in the environment, the flag takes precedence
+		if value := os.Getenv("CERTMANAGER_RENEW_BEFORE"); value != "" && !cmd.Flags().Changed("renew-before") {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				return errors.Wrapf(err, "invalid CERTMANAGER_RENEW_BEFORE value %q", value)
+			}
+			validateRenewBefore = parsed
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			return errors.Wrapf(err, "failed to read config file %s", args[0])
+		}
+
+		report := validationReport{File: args[0], Errors: certmanager.ValidationErrors{}}
+		tasks, err := certmanager.DecodeTasks(data)
+		if err != nil {
+			report.Errors = append(report.Errors, toValidationErrors(err)...)
+		} else {
+			report.Tasks = len(tasks)
+			report.Errors = append(report.Errors, certmanager.ValidateTasks(tasks, validateRenewBefore)...)
+			if validateResolve {
+				report.Errors = append(report.Errors, certmanager.ResolveDomains(ctx, tasks)...)
+			}
+		}
+		report.Valid = len(report.Errors) == 0
+
+		if validateFormat == "json" {
+			out, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return errors.Wrap(err, "failed to marshal validation report")
+			}
+			fmt.Println(string(out))
+		} else {
+			for _, e := range report.Errors {
+				fmt.Println(e.Error())
+			}
+			if report.Valid {
+				fmt.Printf("%s is valid, %d tasks\n", report.File, report.Tasks)
+			}
+		}
+
+		if !report.Valid {
+			// the report already lists the problems, the usage would only hide it
+			cmd.SilenceUsage = true
+			return errors.Wrapf(ErrInvalidConfig, "%s: %d problems found", report.File, len(report.Errors))
+		}
+
+		return nil
+	},
+}
+
+func toValidationErrors(err error) certmanager.ValidationErrors {
+	var errs certmanager.ValidationErrors
+	if errors.As(err, &errs) {
+		return errs
+	}
+
+	return certmanager.ValidationErrors{{Index: -1, Message: err.Error()}}
+}
+
+func initValidateCmd() {
+	validateCmd.Flags().BoolVar(&validateResolve, "resolve", false, "check that every task domain resolves in DNS")
+	validateCmd.Flags().StringVar(&validateFormat, "format", "json", "output format, json or text")
+	validateCmd.Flags().DurationVar(
+		&validateRenewBefore,
+		"renew-before",
+		certmanager.DefaultRenewBefore,
+		"global renewal window which certificates of local issuers must outlive, CERTMANAGER_RENEW_BEFORE if set",
+	)
+	RootCmd.AddCommand(validateCmd)
+}
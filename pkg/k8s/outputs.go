@@ -0,0 +1,239 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/pavlo-v-chernykh/keystore-go/v4"
+	"github.com/pkg/errors"
+	"software.sslmate.com/src/go-pkcs12"
+	"time"
+)
+
+const (
+	CACertKey        = "ca.crt"
+	defaultCombined  = "tls-combined.pem"
+	defaultPKCS12Key = "keystore.p12"
+	defaultJKSKey    = "keystore.jks"
+	defaultPassword  = "password"
+	defaultJKSAlias  = "certificate"
+)
+
+// OutputConfig adds extra representations of the certificate to the secret, they are regenerated on every renewal
+type OutputConfig struct {
+	// CA writes the issuer chain without the leaf certificate to ca.crt
+	CA bool `json:"CA,omitempty"`
+	// Combined writes the certificate followed by the private key to tls-combined.pem
+	Combined bool            `json:"Combined,omitempty"`
+	PKCS12   *KeystoreConfig `json:"PKCS12,omitempty"`
+	JKS      *KeystoreConfig `json:"JKS,omitempty"`
+}
+
+// KeystoreConfig describes a password protected keystore, the password is read from a secret in the task namespace
+type KeystoreConfig struct {
+	PasswordSecret string `json:"PasswordSecret"`
+	// PasswordKey is the key of the password in PasswordSecret, "password" by default
+	PasswordKey string `json:"PasswordKey,omitempty"`
+	// Key is the key of the keystore in the TLS secret, keystore.p12 or keystore.jks by default
+	Key string `json:"Key,omitempty"`
+	// Alias of the private key entry in JKS keystores, "certificate" by default
+	Alias string `json:"Alias,omitempty"`
+}
+
+func (c *OutputConfig) Validate() error {
+	for name, ks := range map[string]*KeystoreConfig{"PKCS12": c.PKCS12, "JKS": c.JKS} {
+		if ks != nil && ks.PasswordSecret == "" {
+			return errors.Errorf("%s output requires PasswordSecret", name)
+		}
+	}
+
+	return nil
+}
+
+// keys lists the secret keys written for the output configuration
+func (c *OutputConfig) keys() []string {
+	if c == nil {
+		return nil
+	}
+
+	keys := []string{}
+	if c.CA {
+		keys = append(keys, CACertKey)
+	}
+	if c.Combined {
+		keys = append(keys, defaultCombined)
+	}
+	if c.PKCS12 != nil {
+		keys = append(keys, keyOrDefault(c.PKCS12.Key, defaultPKCS12Key))
+	}
+	if c.JKS != nil {
+		keys = append(keys, keyOrDefault(c.JKS.Key, defaultJKSKey))
+	}
+
+	return keys
+}
+
+// hasOutputs checks if all configured output keys are present in the secret data
+func (c *OutputConfig) hasOutputs(data map[string][]byte) bool {
+	for _, key := range c.keys() {
+		if _, ok := data[key]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// buildOutputs generates the configured outputs from the PEM bundle and key
+func (sm *SecretManager) buildOutputs(ctx context.Context, namespace string, certPEM, keyPEM []byte, cfg *OutputConfig) (map[string][]byte, error) {
+	out := map[string][]byte{}
+	if cfg == nil {
+		return out, nil
+	}
+
+	chain, err := parseChain(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CA {
+		out[CACertKey] = encodeCerts(chain[1:])
+	}
+
+	if cfg.Combined {
+		combined := append(bytes.TrimRight(certPEM, "\n"), '\n')
+		out[defaultCombined] = append(combined, keyPEM...)
+	}
+
+	if cfg.PKCS12 == nil && cfg.JKS == nil {
+		return out, nil
+	}
+
+	privateKey, err := certcrypto.ParsePEMPrivateKey(keyPEM)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse private key for keystore outputs")
+	}
+
+	if cfg.PKCS12 != nil {
+		password, err := sm.readPassword(ctx, namespace, cfg.PKCS12)
+		if err != nil {
+			return nil, err
+		}
+
+		pfx, err := pkcs12.Modern.Encode(privateKey, chain[0], chain[1:], password)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encode PKCS#12 keystore")
+		}
+		out[keyOrDefault(cfg.PKCS12.Key, defaultPKCS12Key)] = pfx
+	}
+
+	if cfg.JKS != nil {
+		password, err := sm.readPassword(ctx, namespace, cfg.JKS)
+		if err != nil {
+			return nil, err
+		}
+
+		jks, err := encodeJKS(privateKey, chain, keyOrDefault(cfg.JKS.Alias, defaultJKSAlias), password)
+		if err != nil {
+			return nil, err
+		}
+		out[keyOrDefault(cfg.JKS.Key, defaultJKSKey)] = jks
+	}
+
+	return out, nil
+}
+
+func (sm *SecretManager) readPassword(ctx context.Context, namespace string, cfg *KeystoreConfig) (string, error) {
+	secret, err := sm.GetSecret(ctx, namespace, cfg.PasswordSecret)
+	if err != nil {
+		return "", err
+	}
+	if secret == nil {
+		return "", errors.Errorf("keystore password secret %s/%s doesn't exist", namespace, cfg.PasswordSecret)
+	}
+
+	passwordKey := keyOrDefault(cfg.PasswordKey, defaultPassword)
+	password, ok := secret.Data[passwordKey]
+	if !ok {
+		return "", errors.Errorf("keystore password secret %s/%s has no %s key", namespace, cfg.PasswordSecret, passwordKey)
+	}
+
+	return string(password), nil
+}
+
+func encodeJKS(privateKey interface{}, chain []*x509.Certificate, alias, password string) ([]byte, error) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal private key for JKS keystore")
+	}
+
+	entry := keystore.PrivateKeyEntry{
+		CreationTime: time.Now(),
+		PrivateKey:   pkcs8,
+	}
+	for _, cert := range chain {
+		entry.CertificateChain = append(entry.CertificateChain, keystore.Certificate{
+			Type:    "X509",
+			Content: cert.Raw,
+		})
+	}
+
+	ks := keystore.New()
+	if err := ks.SetPrivateKeyEntry(alias, entry, []byte(password)); err != nil {
+		return nil, errors.Wrap(err, "failed to add private key to JKS keystore")
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ks.Store(buf, []byte(password)); err != nil {
+		return nil, errors.Wrap(err, "failed to encode JKS keystore")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// parseChain decodes all certificates of the PEM bundle, the leaf certificate is the first one
+func parseChain(certPEM []byte) ([]*x509.Certificate, error) {
+	chain := []*x509.Certificate{}
+	rest := certPEM
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse certificate chain")
+		}
+		chain = append(chain, cert)
+	}
+
+	if len(chain) == 0 {
+		return nil, errors.New("no certificates found in the PEM bundle")
+	}
+
+	return chain, nil
+}
+
+func encodeCerts(certs []*x509.Certificate) []byte {
+	buf := &bytes.Buffer{}
+	for _, cert := range certs {
+		_ = pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+
+	return buf.Bytes()
+}
+
+func keyOrDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+
+	return value
+}
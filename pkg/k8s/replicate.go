@@ -0,0 +1,161 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"sort"
+	"strings"
+)
+
+const (
+	annotationPrefix = "certmanager.breathbath.github.io/"
+	// AnnotationReplicaOf marks secrets copied from another namespace, its value is the source secret in namespace/name form
+	AnnotationReplicaOf = annotationPrefix + "replica-of"
+)
+
+// ResolveNamespaces returns the listed namespaces together with the ones matching the label selector
+func (sm *SecretManager) ResolveNamespaces(ctx context.Context, names []string, selector string) ([]string, error) {
+	unique := map[string]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			unique[name] = true
+		}
+	}
+
+	if selector != "" {
+		list, err := sm.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list namespaces matching %q", selector)
+		}
+		for _, ns := range list.Items {
+			if ns.Status.Phase != v1.NamespaceTerminating {
+				unique[ns.Name] = true
+			}
+		}
+	}
+
+	namespaces := make([]string, 0, len(unique))
+	for name := range unique {
+		namespaces = append(namespaces, name)
+	}
+	sort.Strings(namespaces)
+
+	return namespaces, nil
+}
+
+// ReplicateTLSSecret copies the TLS secret from the source namespace to the target ones,
+// copies which are already identical are left untouched, namespaces with a changed copy are returned
+func (sm *SecretManager) ReplicateTLSSecret(ctx context.Context, sourceNamespace, secretName string, targets []string) ([]string, error) {
+	log := logging.FromContext(ctx)
+	source, err := sm.GetSecret(ctx, sourceNamespace, secretName)
+	if err != nil {
+		return nil, err
+	}
+	if source == nil {
+		return nil, errors.Errorf("source secret %s/%s for replication doesn't exist", sourceNamespace, secretName)
+	}
+
+	secretData := map[string][]byte{}
+	for k, v := range source.Data {
+		secretData[k] = v
+	}
+	annotations := map[string]string{
+		AnnotationReplicaOf: sourceNamespace + "/" + secretName,
+	}
+	for k, v := range source.Annotations {
+		if strings.HasPrefix(k, annotationPrefix) {
+			annotations[k] = v
+		}
+	}
+
+	changed := []string{}
+	failed := []string{}
+	for _, namespace := range targets {
+		if namespace == sourceNamespace {
+			continue
+		}
+
+		replica, err := sm.GetSecret(ctx, namespace, secretName)
+		if err == nil && replica == nil {
+			err = sm.createSecret(ctx, namespace, secretName, secretData, annotations)
+		} else if err == nil && !sameData(replica.Data, secretData) {
+			err = sm.updateSecret(ctx, replica, secretData, annotations)
+		} else if err == nil {
+			log.Debugf("replica %s/%s is up to date", namespace, secretName)
+			continue
+		}
+
+		if err != nil {
+			log.WithError(err).Errorf("failed to replicate secret %s/%s to namespace %s", sourceNamespace, secretName, namespace)
+			failed = append(failed, namespace)
+			continue
+		}
+
+		changed = append(changed, namespace)
+	}
+
+	if len(failed) > 0 {
+		return changed, errors.Errorf(
+			"failed to replicate secret %s/%s to namespaces %s",
+			sourceNamespace,
+			secretName,
+			strings.Join(failed, ", "),
+		)
+	}
+
+	return changed, nil
+}
+
+// WatchNewNamespaces calls onAdded for every namespace created while the context is active, the watch is restarted if the API server closes it
+func (sm *SecretManager) WatchNewNamespaces(ctx context.Context, onAdded func(namespace string, nsLabels labels.Set)) error {
+	list, err := sm.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "failed to list namespaces")
+	}
+	resourceVersion := list.ResourceVersion
+
+	for ctx.Err() == nil {
+		w, err := sm.clientset.CoreV1().Namespaces().Watch(ctx, metav1.ListOptions{ResourceVersion: resourceVersion})
+		if err != nil {
+			return errors.Wrap(err, "failed to watch namespaces")
+		}
+
+		for event := range w.ResultChan() {
+			ns, ok := event.Object.(*v1.Namespace)
+			if !ok {
+				// the resource version is too old, continue from the current state
+				resourceVersion = ""
+				continue
+			}
+			resourceVersion = ns.ResourceVersion
+
+			if event.Type == watch.Added {
+				onAdded(ns.Name, labels.Set(ns.Labels))
+			}
+		}
+		w.Stop()
+	}
+
+	return nil
+}
+
+func sameData(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if !bytes.Equal(v, b[k]) {
+			return false
+		}
+	}
+
+	return true
+}
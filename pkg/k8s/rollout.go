@@ -0,0 +1,259 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+	"time"
+)
+
+const (
+	KindDeployment  = "deployment"
+	KindStatefulSet = "statefulset"
+	KindDaemonSet   = "daemonset"
+
+	// restartedAtAnnotation is the pod template annotation used by kubectl rollout restart
+	restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+)
+
+// RolloutConfig lists workloads which are restarted after the certificate in the secret changes
+type RolloutConfig struct {
+	// Workloads are given in the kind/name form e.g. deployment/api, statefulset/db or daemonset/proxy
+	Workloads []string `json:"Workloads,omitempty"`
+	// Selector is a label selector matching deployments, statefulsets and daemonsets to restart
+	Selector string `json:"Selector,omitempty"`
+	// AutoDetect restarts all workloads whose pods mount the secret or read it into env variables
+	AutoDetect bool `json:"AutoDetect,omitempty"`
+}
+
+type workloadRef struct {
+	kind string
+	name string
+}
+
+func (w workloadRef) String() string {
+	return w.kind + "/" + w.name
+}
+
+func parseWorkloadRef(ref string) (workloadRef, error) {
+	parts := strings.Split(strings.TrimSpace(ref), "/")
+	if len(parts) != 2 || parts[1] == "" {
+		return workloadRef{}, errors.Errorf("invalid workload reference %q, expected kind/name", ref)
+	}
+
+	kind := strings.ToLower(parts[0])
+	switch kind {
+	case KindDeployment, KindStatefulSet, KindDaemonSet:
+	default:
+		return workloadRef{}, errors.Errorf("unsupported workload kind %q in %q", parts[0], ref)
+	}
+
+	return workloadRef{kind: kind, name: parts[1]}, nil
+}
+
+// Validate checks workload references and the label selector syntax
+func (c *RolloutConfig) Validate() error {
+	for _, ref := range c.Workloads {
+		if _, err := parseWorkloadRef(ref); err != nil {
+			return err
+		}
+	}
+
+	if c.Selector != "" {
+		if _, err := metav1.ParseToLabelSelector(c.Selector); err != nil {
+			return errors.Wrapf(err, "invalid workload selector %q", c.Selector)
+		}
+	}
+
+	return nil
+}
+
+type WorkloadRestarter struct {
+	clientset *kubernetes.Clientset
+	// dryRun only logs the workloads which would be restarted
+	dryRun bool
+}
+
+func NewWorkloadRestarter(clientset *kubernetes.Clientset, dryRun bool) *WorkloadRestarter {
+	return &WorkloadRestarter{clientset: clientset, dryRun: dryRun}
+}
+
+// Restart triggers a rolling restart of the configured workloads in the namespace the same way kubectl rollout restart does
+func (wr *WorkloadRestarter) Restart(ctx context.Context, namespace, secretName string, cfg *RolloutConfig) error {
+	log := logging.FromContext(ctx)
+	if cfg == nil {
+		return nil
+	}
+
+	refs, err := wr.resolve(ctx, namespace, secretName, cfg)
+	if err != nil {
+		return err
+	}
+
+	if len(refs) == 0 {
+		log.Infof("no workloads to restart after update of secret %s/%s", namespace, secretName)
+		return nil
+	}
+
+	patch := []byte(fmt.Sprintf(
+		`{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`,
+		restartedAtAnnotation,
+		time.Now().UTC().Format(time.RFC3339),
+	))
+
+	failed := []string{}
+	for _, ref := range refs {
+		if wr.dryRun {
+			log.Infof("dry run: would restart %s/%s after update of secret %s", namespace, ref, secretName)
+			continue
+		}
+		if err := wr.patch(ctx, namespace, ref, patch); err != nil {
+			log.WithError(err).Errorf("failed to restart %s/%s", namespace, ref)
+			failed = append(failed, ref.String())
+			continue
+		}
+		log.Infof("restarted %s/%s after update of secret %s", namespace, ref, secretName)
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf("failed to restart workloads %s in namespace %s", strings.Join(failed, ", "), namespace)
+	}
+
+	return nil
+}
+
+func (wr *WorkloadRestarter) patch(ctx context.Context, namespace string, ref workloadRef, patch []byte) error {
+	var err error
+	apps := wr.clientset.AppsV1()
+
+	switch ref.kind {
+	case KindDeployment:
+		_, err = apps.Deployments(namespace).Patch(ctx, ref.name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	case KindStatefulSet:
+		_, err = apps.StatefulSets(namespace).Patch(ctx, ref.name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	case KindDaemonSet:
+		_, err = apps.DaemonSets(namespace).Patch(ctx, ref.name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	}
+
+	return err
+}
+
+// resolve collects unique workloads from the explicit list, the selector and the auto detection
+func (wr *WorkloadRestarter) resolve(ctx context.Context, namespace, secretName string, cfg *RolloutConfig) ([]workloadRef, error) {
+	seen := map[workloadRef]bool{}
+	refs := []workloadRef{}
+	add := func(ref workloadRef) {
+		if !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+
+	for _, w := range cfg.Workloads {
+		ref, err := parseWorkloadRef(w)
+		if err != nil {
+			return nil, err
+		}
+		add(ref)
+	}
+
+	if cfg.Selector == "" && !cfg.AutoDetect {
+		return refs, nil
+	}
+
+	opts := metav1.ListOptions{}
+	if !cfg.AutoDetect {
+		opts.LabelSelector = cfg.Selector
+	}
+
+	// with auto detection all workloads are listed and the selector is applied to ones not using the secret
+	selector, err := metav1.ParseToLabelSelector(cfg.Selector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid workload selector %q", cfg.Selector)
+	}
+	labelSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid workload selector %q", cfg.Selector)
+	}
+
+	matches := func(workloadLabels map[string]string, spec v1.PodSpec) bool {
+		if cfg.AutoDetect && usesSecret(spec, secretName) {
+			return true
+		}
+		return cfg.Selector != "" && labelSelector.Matches(labels.Set(workloadLabels))
+	}
+
+	apps := wr.clientset.AppsV1()
+
+	deployments, err := apps.Deployments(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list deployments in namespace %s", namespace)
+	}
+	for _, d := range deployments.Items {
+		if matches(d.Labels, d.Spec.Template.Spec) {
+			add(workloadRef{kind: KindDeployment, name: d.Name})
+		}
+	}
+
+	statefulSets, err := apps.StatefulSets(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list statefulsets in namespace %s", namespace)
+	}
+	for _, s := range statefulSets.Items {
+		if matches(s.Labels, s.Spec.Template.Spec) {
+			add(workloadRef{kind: KindStatefulSet, name: s.Name})
+		}
+	}
+
+	daemonSets, err := apps.DaemonSets(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list daemonsets in namespace %s", namespace)
+	}
+	for _, ds := range daemonSets.Items {
+		if matches(ds.Labels, ds.Spec.Template.Spec) {
+			add(workloadRef{kind: KindDaemonSet, name: ds.Name})
+		}
+	}
+
+	return refs, nil
+}
+
+// usesSecret checks if pods with the spec mount the secret as a volume or read it into env variables
+func usesSecret(spec v1.PodSpec, secretName string) bool {
+	for _, vol := range spec.Volumes {
+		if vol.Secret != nil && vol.Secret.SecretName == secretName {
+			return true
+		}
+		if vol.Projected != nil {
+			for _, src := range vol.Projected.Sources {
+				if src.Secret != nil && src.Secret.Name == secretName {
+					return true
+				}
+			}
+		}
+	}
+
+	containers := append([]v1.Container{}, spec.InitContainers...)
+	containers = append(containers, spec.Containers...)
+	for _, c := range containers {
+		for _, envFrom := range c.EnvFrom {
+			if envFrom.SecretRef != nil && envFrom.SecretRef.Name == secretName {
+				return true
+			}
+		}
+		for _, env := range c.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil && env.ValueFrom.SecretKeyRef.Name == secretName {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -3,15 +3,18 @@ package k8s
 import (
 	"context"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
-	"fmt"
+	"github.com/breathbath/certmanager/pkg/backup"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/breathbath/certmanager/pkg/sink"
+	"github.com/breathbath/certmanager/pkg/tracing"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"os"
-	"path/filepath"
-	"sigs.k8s.io/yaml"
+	"k8s.io/apimachinery/pkg/types"
+	"sort"
 	"strings"
 	"time"
 
@@ -21,118 +24,266 @@ import (
 
 type SecretManager struct {
 	clientset *kubernetes.Clientset
+	backups   *backup.Store
+	// dryRun only logs secret writes, patches and backups instead of doing them
+	dryRun bool
 }
 
-func NewSecretManager(clientset *kubernetes.Clientset) *SecretManager {
-	return &SecretManager{clientset: clientset}
+// NewSecretManager creates a SecretManager, backups can be nil if certificate data shouldn't be backed up
+func NewSecretManager(clientset *kubernetes.Clientset, backups *backup.Store, dryRun bool) *SecretManager {
+	return &SecretManager{clientset: clientset, backups: backups, dryRun: dryRun}
 }
 
+// TLSSecretRequest describes the desired state of a TLS secret
+type TLSSecretRequest struct {
+	Namespace  string
+	Domain     string
+	SecretName string
+	// Email is passed to the issue function, it can be empty for issuers without accounts
+	Email string
+	// Force reissues the certificate even if the current one is valid
+	Force bool
+	// RenewBefore is the remaining validity of the current certificate when it gets renewed
+	RenewBefore time.Duration
+	Outputs     *OutputConfig
+}
+
+// EnsureTLSSecret makes sure the secret holds a valid certificate together with the configured outputs
 func (sm *SecretManager) EnsureTLSSecret(
 	ctx context.Context,
-	namespace, domain, secretName, email string,
-	backupPath string,
-	issue func(mail, domain string) (certPEM, keyPEM []byte, err error),
-) error {
-	if namespace == "" || domain == "" || secretName == "" || email == "" {
-		return errors.New("namespace, domain, secretName and email must be set")
+	req TLSSecretRequest,
+	issue func(mail, domain string) (*sink.Certificate, error),
+) (res *sink.Result, err error) {
+	ctx, span := tracing.Start(ctx, "EnsureTLSSecret", tracing.Task(req.Namespace, req.SecretName, req.Domain)...)
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	namespace, domain, secretName, email := strings.TrimSpace(req.Namespace), req.Domain, req.SecretName, req.Email
+	if namespace == "" || domain == "" || secretName == "" {
+		return &sink.Result{}, errors.New("namespace, domain and secretName must be set")
 	}
 
-	minValidity := 1 * time.Hour
+	return sink.Ensure(
+		ctx,
+		&secretSink{sm: sm, namespace: namespace, name: secretName, domain: domain, outputs: req.Outputs},
+		sink.Request{Domain: domain, Force: req.Force, RenewBefore: req.RenewBefore},
+		func() (*sink.Certificate, error) {
+			return issue(email, domain)
+		},
+	)
+}
+
+// secretSink stores certificates in a TLS secret together with the configured outputs
+type secretSink struct {
+	sm        *SecretManager
+	namespace string
+	name      string
+	domain    string
+	outputs   *OutputConfig
+	// secret is the one found by Load, nil if it doesn't exist
+	secret *v1.Secret
+}
 
-	namespace = strings.TrimSpace(namespace)
+func (s *secretSink) String() string {
+	return "secret " + s.namespace + "/" + s.name
+}
 
-	secret, err := sm.clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
-	if err != nil && !apierrors.IsNotFound(err) {
-		return errors.Wrapf(err, "failed to request secret %s/%s from k8s api", namespace, secretName)
+func (s *secretSink) Load(ctx context.Context) (*x509.Certificate, error) {
+	secret, err := s.sm.GetSecret(ctx, s.namespace, s.name)
+	if err != nil || secret == nil {
+		return nil, err
 	}
+	s.secret = secret
 
-	isSecretFound := !apierrors.IsNotFound(err)
+	cert, err := ParseCertificate(secret)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("%s has no readable certificate: %v", s, err)
+		return nil, nil
+	}
 
-	logrus.Infof("secret %s/%s found: %v", namespace, secretName, isSecretFound)
+	return cert, nil
+}
 
-	if isSecretFound && sm.IsCertValid(secret, minValidity) {
-		logrus.Infof("secret %s/%s already exists and is valid", namespace, secretName)
+// Complete generates configured outputs which are missing in the secret of a valid certificate
+func (s *secretSink) Complete(ctx context.Context) error {
+	if s.outputs.hasOutputs(s.secret.Data) {
 		return nil
 	}
 
-	logrus.Infof("secret %s/%s does not exist or is not valid, generating a new one", namespace, secretName)
+	logging.FromContext(ctx).Infof("%s misses configured outputs, generating them", s)
+	secretData, err := s.sm.buildSecretData(ctx, s.namespace, s.secret.Data["tls.crt"], s.secret.Data["tls.key"], s.outputs)
+	if err != nil {
+		return err
+	}
 
-	certPEM, keyPEM, err := issue(email, domain)
+	return s.sm.updateSecret(ctx, s.secret, secretData, nil)
+}
+
+func (s *secretSink) Store(ctx context.Context, issued *sink.Certificate) error {
+	secretData, err := s.sm.buildSecretData(ctx, s.namespace, issued.CertPEM, issued.KeyPEM, s.outputs)
 	if err != nil {
-		return errors.Wrapf(err, "failed to generate cert for %s", domain)
+		return err
+	}
+	annotations := map[string]string{
+		backup.AnnotationCertURL: issued.CertURL,
 	}
 
-	secretData := map[string][]byte{
-		"tls.crt": certPEM,
-		"tls.key": keyPEM,
+	var replaced *v1.Secret
+	if s.secret != nil {
+		replaced = s.secret.DeepCopy()
+		err = s.sm.updateSecret(ctx, s.secret, secretData, annotations)
+	} else {
+		err = s.sm.createSecret(ctx, s.namespace, s.name, secretData, annotations)
+	}
+	if err != nil {
+		return err
 	}
 
-	tlsSecret := &v1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      secretName,
-			Namespace: namespace,
+	s.sm.archive(ctx, replaced, s.namespace, s.name, issued)
+
+	return nil
+}
+
+func (s *secretSink) BackupOnFailure(ctx context.Context, issued *sink.Certificate) string {
+	return s.sm.backupOnFailure(ctx, s.namespace, s.name, s.domain, issued.CertPEM, issued.KeyPEM)
+}
+
+// PatchAnnotations sets the annotations on the existing secret leaving its data untouched
+func (sm *SecretManager) PatchAnnotations(ctx context.Context, namespace, secretName string, annotations map[string]string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
 		},
-		Type: v1.SecretTypeTLS,
-		Data: secretData,
+	})
+	if sm.dryRun {
+		logging.FromContext(ctx).Infof("dry run: would set annotations %s on secret %s/%s", string(patch), namespace, secretName)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal annotations patch")
 	}
 
-	if isSecretFound {
-		// Update existing secret with retry on conflict
-		updated := false
-		var lastErr error
-		for i := 0; i < 3; i++ {
-			secret.Data = secretData
-			secret.Type = v1.SecretTypeTLS
-
-			if _, err := sm.clientset.CoreV1().Secrets(namespace).Update(context.TODO(), secret, metav1.UpdateOptions{}); err != nil {
-				if apierrors.IsConflict(err) {
-					secret, err = sm.clientset.CoreV1().Secrets(namespace).Get(context.TODO(), secretName, metav1.GetOptions{})
-					if err != nil {
-						lastErr = errors.Wrapf(err, "failed to get secret %s/%s on conflict retry", namespace, secretName)
-						break
-					}
-					continue
-				}
-				lastErr = errors.Wrapf(err, "failed to update secret %s/%s", namespace, secretName)
-				break
-			}
+	_, err = sm.clientset.CoreV1().Secrets(namespace).Patch(ctx, secretName, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to patch annotations of secret %s/%s", namespace, secretName)
+	}
 
-			logrus.Infof("updated secret %s/%s", namespace, secretName)
+	return nil
+}
 
-			updated = true
-			lastErr = nil
-			break
-		}
-		if !updated {
-			if lastErr == nil {
-				lastErr = errors.Errorf("failed to update secret %s/%s after retries", namespace, secretName)
-			}
-			sm.backupOnFailure(backupPath, namespace, secretName, domain, certPEM, keyPEM)
-			return lastErr
+// SaveSecretData creates an opaque secret with the data or replaces the data of the existing secret
+func (sm *SecretManager) SaveSecretData(ctx context.Context, namespace, secretName string, data map[string][]byte) error {
+	log := logging.FromContext(ctx)
+	if sm.dryRun {
+		log.Infof("dry run: would save secret %s/%s with keys %s", namespace, secretName, strings.Join(dataKeys(data), ", "))
+		return nil
+	}
+
+	secret, err := sm.GetSecret(ctx, namespace, secretName)
+	if err != nil {
+		return err
+	}
+
+	if secret == nil {
+		secret = &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: namespace},
+			Type:       v1.SecretTypeOpaque,
+			Data:       data,
 		}
-	} else {
-		if _, err := sm.clientset.CoreV1().Secrets(namespace).Create(context.TODO(), tlsSecret, metav1.CreateOptions{}); err != nil {
-			sm.backupOnFailure(backupPath, namespace, secretName, domain, certPEM, keyPEM)
+		if _, err := sm.clientset.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
 			return errors.Wrapf(err, "failed to create secret %s/%s", namespace, secretName)
 		}
-		logrus.Infof("created secret %s/%s", namespace, secretName)
+		log.Infof("created secret %s/%s", namespace, secretName)
+
+		return nil
 	}
 
+	secret.Data = data
+	if _, err := sm.clientset.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return errors.Wrapf(err, "failed to update secret %s/%s", namespace, secretName)
+	}
+	log.Infof("updated secret %s/%s", namespace, secretName)
+
 	return nil
 }
 
-func (sm *SecretManager) IsCertValid(secret *v1.Secret, minValidity time.Duration) bool {
+// buildSecretData returns the TLS secret data together with the configured outputs
+func (sm *SecretManager) buildSecretData(
+	ctx context.Context,
+	namespace string,
+	certPEM, keyPEM []byte,
+	outputs *OutputConfig,
+) (map[string][]byte, error) {
+	secretData, err := sm.buildOutputs(ctx, namespace, certPEM, keyPEM, outputs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate outputs for secret in namespace %s", namespace)
+	}
+
+	secretData["tls.crt"] = certPEM
+	secretData["tls.key"] = keyPEM
+
+	return secretData, nil
+}
+
+// GetSecret returns the secret or nil if it doesn't exist
+func (sm *SecretManager) GetSecret(ctx context.Context, namespace, secretName string) (*v1.Secret, error) {
+	secret, err := sm.clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to request secret %s/%s from k8s api", namespace, secretName)
+	}
+
+	return secret, nil
+}
+
+// ListTLSSecrets returns all secrets of the kubernetes.io/tls type in the namespace, an empty namespace lists all namespaces
+func (sm *SecretManager) ListTLSSecrets(ctx context.Context, namespace string) ([]v1.Secret, error) {
+	list, err := sm.clientset.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: "type=" + string(v1.SecretTypeTLS),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list TLS secrets in namespace %q", namespace)
+	}
+
+	return list.Items, nil
+}
+
+// GetCertificate returns the leaf certificate stored in the given TLS secret,
+// nil is returned if the secret doesn't exist.
+func (sm *SecretManager) GetCertificate(ctx context.Context, namespace, secretName string) (*x509.Certificate, error) {
+	secret, err := sm.GetSecret(ctx, namespace, secretName)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+
+	return ParseCertificate(secret)
+}
+
+// ParseCertificate decodes the first certificate from the tls.crt key of the secret.
+func ParseCertificate(secret *v1.Secret) (*x509.Certificate, error) {
 	crtData, ok := secret.Data["tls.crt"]
 	if !ok {
-		return false
+		return nil, errors.Errorf("secret %s/%s has no tls.crt key", secret.Namespace, secret.Name)
 	}
 
 	block, _ := pem.Decode(crtData)
 	if block == nil {
-		return false
+		return nil, errors.Errorf("secret %s/%s contains no PEM data in tls.crt", secret.Namespace, secret.Name)
 	}
 
 	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse certificate from secret %s/%s", secret.Namespace, secret.Name)
+	}
+
+	return cert, nil
+}
+
+func (sm *SecretManager) IsCertValid(secret *v1.Secret, minValidity time.Duration) bool {
+	cert, err := ParseCertificate(secret)
 	if err != nil {
 		return false
 	}
@@ -140,97 +291,173 @@ func (sm *SecretManager) IsCertValid(secret *v1.Secret, minValidity time.Duratio
 	return cert.NotAfter.After(time.Now().Add(minValidity))
 }
 
-func (sm *SecretManager) backupOnFailure(
-	backupPath, namespace, secretName, domain string,
-	certPEM, keyPEM []byte,
-) {
-	if strings.TrimSpace(backupPath) == "" {
-		return
+// RestoreBackup verifies the certificate from the backup and writes it to the secret it was taken from
+func (sm *SecretManager) RestoreBackup(ctx context.Context, b *backup.Backup) error {
+	if err := b.Verify(time.Now()); err != nil {
+		return err
+	}
+
+	namespace, secretName := b.Namespace(), b.SecretName()
+	secretData := map[string][]byte{
+		"tls.crt": b.Secret.Data["tls.crt"],
+		"tls.key": b.Secret.Data["tls.key"],
+	}
+	annotations := map[string]string{
+		backup.AnnotationCertURL: backup.VersionOf(b).CertURL,
 	}
 
-	backupFilePath, err := sm.backupSecretData(backupPath, namespace, secretName, domain, certPEM, keyPEM)
+	secret, err := sm.clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return sm.createSecret(ctx, namespace, secretName, secretData, annotations)
+	}
 	if err != nil {
-		logrus.WithError(err).Warn("failed to back up certificate data after secret install failure")
-		return
+		return errors.Wrapf(err, "failed to request secret %s/%s from k8s api", namespace, secretName)
 	}
 
-	logrus.Infof("backed up certificate data to %s", backupFilePath)
+	return sm.updateSecret(ctx, secret, secretData, annotations)
 }
 
-func (sm *SecretManager) backupSecretData(
-	backupPath, namespace, secretName, domain string,
-	certPEM, keyPEM []byte,
-) (string, error) {
-	safeNamespace := sanitizeName(namespace)
-	safeSecret := sanitizeName(secretName)
-	safeDomain := sanitizeName(domain)
-	timestamp := time.Now().UTC().Format("20060102T150405Z")
+func (sm *SecretManager) createSecret(
+	ctx context.Context,
+	namespace, secretName string,
+	secretData map[string][]byte,
+	annotations map[string]string,
+) (err error) {
+	ctx, span := tracing.Start(ctx, "k8s.createSecret", attribute.String("certmanager.namespace", namespace))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	log := logging.FromContext(ctx)
+	tlsSecret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secretName,
+			Namespace:   namespace,
+			Annotations: annotations,
+		},
+		Type: v1.SecretTypeTLS,
+		Data: secretData,
+	}
 
-	if err := os.MkdirAll(backupPath, 0755); err != nil {
-		return "", errors.Wrapf(err, "failed to create backup path %s", backupPath)
+	if sm.dryRun {
+		log.Infof("dry run: would create secret %s/%s with keys %s", namespace, secretName, strings.Join(dataKeys(secretData), ", "))
+		return nil
 	}
-	info, err := os.Stat(backupPath)
-	if err != nil {
-		return "", errors.Wrapf(err, "backup path %s is not accessible", backupPath)
+
+	if _, err := sm.clientset.CoreV1().Secrets(namespace).Create(ctx, tlsSecret, metav1.CreateOptions{}); err != nil {
+		return errors.Wrapf(err, "failed to create secret %s/%s", namespace, secretName)
+	}
+	log.Infof("created secret %s/%s", namespace, secretName)
+
+	return nil
+}
+
+// updateSecret replaces the data of an existing secret with retry on conflict
+func (sm *SecretManager) updateSecret(
+	ctx context.Context,
+	secret *v1.Secret,
+	secretData map[string][]byte,
+	annotations map[string]string,
+) (err error) {
+	ctx, span := tracing.Start(ctx, "k8s.updateSecret", attribute.String("certmanager.namespace", secret.Namespace))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	log := logging.FromContext(ctx)
+	namespace, secretName := secret.Namespace, secret.Name
+	if sm.dryRun {
+		log.Infof("dry run: would update secret %s/%s with keys %s", namespace, secretName, strings.Join(dataKeys(secretData), ", "))
+		return nil
 	}
-	if !info.IsDir() {
-		return "", errors.Errorf("backup path %s is not a directory", backupPath)
+
+	for i := 0; i < 3; i++ {
+		secret.Data = secretData
+		secret.Type = v1.SecretTypeTLS
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+		for k, v := range annotations {
+			secret.Annotations[k] = v
+		}
+
+		if _, err = sm.clientset.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			if apierrors.IsConflict(err) {
+				secret, err = sm.clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+				if err != nil {
+					return errors.Wrapf(err, "failed to get secret %s/%s on conflict retry", namespace, secretName)
+				}
+				continue
+			}
+			return errors.Wrapf(err, "failed to update secret %s/%s", namespace, secretName)
+		}
+
+		log.Infof("updated secret %s/%s", namespace, secretName)
+
+		return nil
 	}
 
-	backupFile := fmt.Sprintf("%s_%s_%s_%s.yaml", safeNamespace, safeSecret, safeDomain, timestamp)
-	secretPath := filepath.Join(backupPath, backupFile)
-	secretYAML, err := buildTLSSecretYAML(namespace, secretName, certPEM, keyPEM)
-	if err != nil {
-		return "", errors.Wrap(err, "failed to build secret manifest")
+	return errors.Errorf("failed to update secret %s/%s after retries", namespace, secretName)
+}
+
+// archive adds the issued certificate and the one it replaced to the secret version history
+func (sm *SecretManager) archive(ctx context.Context, replaced *v1.Secret, namespace, secretName string, issued *sink.Certificate) {
+	log := logging.FromContext(ctx)
+	if sm.dryRun || sm.backups == nil || !sm.backups.HistoryEnabled() {
+		return
 	}
-	if err := os.WriteFile(secretPath, []byte(secretYAML), 0644); err != nil {
-		return "", errors.Wrapf(err, "failed to write secret backup %s", secretPath)
+
+	if replaced != nil && len(replaced.Data["tls.crt"]) > 0 {
+		_, err := sm.backups.Archive(
+			namespace,
+			secretName,
+			replaced.Data["tls.crt"],
+			replaced.Data["tls.key"],
+			replaced.Annotations[backup.AnnotationCertURL],
+			backup.ArchiveReasonReplaced,
+		)
+		if err != nil {
+			log.WithError(err).Warnf("failed to archive replaced certificate of secret %s/%s", namespace, secretName)
+		}
 	}
 
-	return secretPath, nil
+	archivePath, err := sm.backups.Archive(namespace, secretName, issued.CertPEM, issued.KeyPEM, issued.CertURL, backup.ArchiveReasonIssued)
+	if err != nil {
+		log.WithError(err).Warnf("failed to archive issued certificate of secret %s/%s", namespace, secretName)
+		return
+	}
+
+	log.Infof("archived issued certificate of secret %s/%s to %s", namespace, secretName, archivePath)
 }
 
-func buildTLSSecretYAML(namespace, secretName string, certPEM, keyPEM []byte) (string, error) {
-	secret := &v1.Secret{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: "v1",
-			Kind:       "Secret",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      secretName,
-			Namespace: namespace,
-		},
-		Type: v1.SecretTypeTLS,
-		Data: map[string][]byte{
-			"tls.crt": certPEM,
-			"tls.key": keyPEM,
-		},
+// backupOnFailure writes the certificate data to the backup store returning the backup file path or an empty string
+func (sm *SecretManager) backupOnFailure(
+	ctx context.Context,
+	namespace, secretName, domain string,
+	certPEM, keyPEM []byte,
+) string {
+	log := logging.FromContext(ctx)
+	if sm.dryRun || sm.backups == nil {
+		return ""
 	}
 
-	out, err := yaml.Marshal(secret)
+	backupFilePath, err := sm.backups.Write(namespace, secretName, domain, certPEM, keyPEM)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to marshal secret yaml")
+		log.WithError(err).Warn("failed to back up certificate data after secret install failure")
+		return ""
 	}
 
-	return string(out), nil
+	log.Infof("backed up certificate data to %s", backupFilePath)
+
+	return backupFilePath
 }
 
-func sanitizeName(value string) string {
-	value = strings.TrimSpace(value)
-	if value == "" {
-		return "unknown"
+func dataKeys(data map[string][]byte) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 
-	return strings.Map(func(r rune) rune {
-		switch {
-		case r >= 'a' && r <= 'z':
-			return r
-		case r >= 'A' && r <= 'Z':
-			return r
-		case r >= '0' && r <= '9':
-			return r
-		default:
-			return '_'
-		}
-	}, value)
+	return keys
 }
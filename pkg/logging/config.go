@@ -3,12 +3,25 @@ package logging
 import (
 	"github.com/kelseyhightower/envconfig"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
+	"time"
 )
 
 type Config struct {
 	LogLevel string `envconfig:"LOGGING_LEVEL"`
-	LogKey   string `envconfig:"LOGGING_KEY"`
+	// LogFormat is json or text
+	LogFormat string `envconfig:"LOGGING_FORMAT" default:"text"`
+	// LogKey is sent as a bearer token to the log shipping endpoint
+	LogKey string `envconfig:"LOGGING_KEY"`
+	// ShipURL turns on log shipping, it's a Loki push API URL or a JSON bulk endpoint
+	ShipURL string `envconfig:"LOGGING_SHIP_URL"`
+	// ShipFormat is loki or json, json posts an array of log entries
+	ShipFormat    string            `envconfig:"LOGGING_SHIP_FORMAT" default:"json"`
+	ShipLabels    map[string]string `envconfig:"LOGGING_SHIP_LABELS" default:"app:certmanager"`
+	ShipBatchSize int               `envconfig:"LOGGING_SHIP_BATCH_SIZE" default:"100"`
+	ShipInterval  time.Duration     `envconfig:"LOGGING_SHIP_INTERVAL" default:"5s"`
+	ShipQueueSize int               `envconfig:"LOGGING_SHIP_QUEUE_SIZE" default:"10000"`
+	ShipRetries   int               `envconfig:"LOGGING_SHIP_RETRIES" default:"3"`
+	ShipTimeout   time.Duration     `envconfig:"LOGGING_SHIP_TIMEOUT" default:"10s"`
 }
 
 func LoadConfig() (cfg *Config, err error) {
@@ -18,7 +31,16 @@ func LoadConfig() (cfg *Config, err error) {
 		return nil, errors.Wrap(err, "failed to load db config")
 	}
 
-	logrus.Infof("loaded logging config: %+v", cfg)
-
 	return cfg, nil
 }
+
+func (c *Config) validateShipping() error {
+	if c.ShipFormat != ShipFormatLoki && c.ShipFormat != ShipFormatJSON {
+		return errors.Errorf("unknown log shipping format %q, expected loki or json", c.ShipFormat)
+	}
+	if c.ShipBatchSize <= 0 || c.ShipQueueSize <= 0 || c.ShipInterval <= 0 {
+		return errors.New("log shipping batch size, queue size and interval must be positive")
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	FieldRunID     = "run_id"
+	FieldNamespace = "namespace"
+	FieldSecret    = "secret"
+	FieldDomain    = "domain"
+)
+
+type loggerKey struct{}
+
+// WithLogger stores the logger in the context, it's used by FromContext in the functions the context is passed to
+func WithLogger(ctx context.Context, log *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// WithFields adds fields to the logger stored in the context
+func WithFields(ctx context.Context, fields logrus.Fields) context.Context {
+	return WithLogger(ctx, FromContext(ctx).WithFields(fields))
+}
+
+// FromContext returns the logger stored in the context or the standard logger without fields
+func FromContext(ctx context.Context) *logrus.Entry {
+	if ctx != nil {
+		if log, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+			return log
+		}
+	}
+
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// NewRunID generates a random ID correlating log lines of one renewal run
+func NewRunID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(buf)
+}
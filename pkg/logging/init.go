@@ -1,23 +1,73 @@
 package logging
 
 import (
+	"context"
 	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
 )
 
+// shipper is set if log shipping is configured
+var shipper *Shipper
+
 func Init() {
-	cfg, _ := LoadConfig()
-	switch cfg.LogLevel {
-	case "info":
-		logrus.SetLevel(logrus.InfoLevel)
-	case "debug":
-		logrus.SetLevel(logrus.DebugLevel)
-	case "error":
-		logrus.SetLevel(logrus.ErrorLevel)
-	case "fatal":
-		logrus.SetLevel(logrus.FatalLevel)
-	case "trace":
-		logrus.SetLevel(logrus.TraceLevel)
+	cfg, err := LoadConfig()
+	if err != nil {
+		logrus.Errorf("invalid logging config, using defaults: %v", err)
+		cfg = &Config{}
+	}
+
+	switch strings.ToLower(cfg.LogFormat) {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case "", "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
 	default:
-		logrus.SetLevel(logrus.DebugLevel)
+		logrus.Warnf("unknown log format %q, using text", cfg.LogFormat)
+	}
+
+	level := logrus.DebugLevel
+	if cfg.LogLevel != "" {
+		// accepts panic, fatal, error, warn, warning, info, debug and trace
+		parsed, err := logrus.ParseLevel(cfg.LogLevel)
+		if err != nil {
+			logrus.Warnf("unknown log level %q, using debug", cfg.LogLevel)
+		} else {
+			level = parsed
+		}
+	}
+	logrus.SetLevel(level)
+
+	// the config isn't logged on load since the formatter isn't set up yet and the key is secret
+	logrus.Infof("loaded logging config: level %s, format %s", level, cfg.LogFormat)
+
+	if cfg.ShipURL == "" {
+		return
+	}
+	if err := cfg.validateShipping(); err != nil {
+		logrus.Errorf("log shipping is disabled: %v", err)
+		return
+	}
+
+	shipper = NewShipper(cfg, nil)
+	shipper.Start()
+	logrus.AddHook(shipper)
+	logrus.Infof("shipping logs in %s format to %s", cfg.ShipFormat, cfg.ShipURL)
+}
+
+// Shutdown sends the logs which are still queued for shipping
+func Shutdown(timeout time.Duration) {
+	if shipper == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := shipper.Close(ctx); err != nil {
+		logrus.Warn(err)
+	}
+	if dropped := shipper.Dropped(); dropped > 0 {
+		logrus.Warnf("%d log entries were not shipped", dropped)
 	}
 }
@@ -0,0 +1,266 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ShipFormatLoki = "loki"
+	ShipFormatJSON = "json"
+)
+
+// shippedEntry is a copy of a log entry taken when it's logged, logrus entries must not be used after Fire returns
+type shippedEntry struct {
+	Time    time.Time
+	Level   string
+	Message string
+	Fields  logrus.Fields
+}
+
+func (e shippedEntry) toMap() map[string]interface{} {
+	out := make(map[string]interface{}, len(e.Fields)+3)
+	for k, v := range e.Fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		out[k] = v
+	}
+	out["time"] = e.Time.UTC().Format(time.RFC3339Nano)
+	out["level"] = e.Level
+	out["msg"] = e.Message
+
+	return out
+}
+
+// Shipper is a logrus hook sending log entries in batches to an HTTP ingestion endpoint,
+// entries are queued without blocking and dropped when the queue is full or the endpoint keeps failing
+type Shipper struct {
+	cfg    *Config
+	client *http.Client
+
+	queue   chan shippedEntry
+	dropped atomic.Uint64
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewShipper creates a shipper for the configured endpoint, a default client is used if client is nil
+func NewShipper(cfg *Config, client *http.Client) *Shipper {
+	if client == nil {
+		client = &http.Client{Timeout: cfg.ShipTimeout}
+	}
+
+	return &Shipper{
+		cfg:    cfg,
+		client: client,
+		queue:  make(chan shippedEntry, cfg.ShipQueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (s *Shipper) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (s *Shipper) Fire(entry *logrus.Entry) error {
+	fields := make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		fields[k] = v
+	}
+
+	select {
+	case s.queue <- shippedEntry{Time: entry.Time, Level: entry.Level.String(), Message: entry.Message, Fields: fields}:
+	default:
+		s.dropped.Add(1)
+	}
+
+	return nil
+}
+
+// Dropped is the number of entries which were not shipped
+func (s *Shipper) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Start sends queued entries in the background until Close is called
+func (s *Shipper) Start() {
+	go s.run()
+}
+
+// Close stops the shipper after sending the queued entries or when the context is done
+func (s *Shipper) Close(ctx context.Context) error {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "log shipper didn't flush in time")
+	}
+}
+
+func (s *Shipper) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.cfg.ShipInterval)
+	defer ticker.Stop()
+
+	batch := make([]shippedEntry, 0, s.cfg.ShipBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		s.send(batch)
+		batch = make([]shippedEntry, 0, s.cfg.ShipBatchSize)
+	}
+
+	for {
+		select {
+		case entry := <-s.queue:
+			batch = append(batch, entry)
+			if len(batch) >= s.cfg.ShipBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-s.stop:
+			for {
+				select {
+				case entry := <-s.queue:
+					batch = append(batch, entry)
+					if len(batch) >= s.cfg.ShipBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// send posts the batch retrying with a growing delay, failures are reported to stderr
+// since logging them would feed them back into the shipper
+func (s *Shipper) send(batch []shippedEntry) {
+	body, err := s.encode(batch)
+	if err != nil {
+		s.dropped.Add(uint64(len(batch)))
+		fmt.Fprintf(os.Stderr, "failed to encode %d log entries: %v\n", len(batch), err)
+		return
+	}
+
+	delay := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err = s.post(body)
+		if err == nil {
+			return
+		}
+		if attempt >= s.cfg.ShipRetries {
+			break
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-s.stop:
+			// shorten the backoff on shutdown, the remaining attempts are still made
+			delay = 0
+		}
+		delay *= 2
+	}
+
+	s.dropped.Add(uint64(len(batch)))
+	fmt.Fprintf(os.Stderr, "dropped %d log entries after %d attempts: %v\n", len(batch), s.cfg.ShipRetries+1, err)
+}
+
+func (s *Shipper) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.cfg.ShipURL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create log shipping request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.cfg.LogKey != "" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.LogKey)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to ship logs")
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("log endpoint returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *Shipper) encode(batch []shippedEntry) ([]byte, error) {
+	if s.cfg.ShipFormat == ShipFormatLoki {
+		return s.encodeLoki(batch)
+	}
+
+	entries := make([]map[string]interface{}, 0, len(batch))
+	for _, e := range batch {
+		entries = append(entries, e.toMap())
+	}
+
+	return json.Marshal(entries)
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// encodeLoki builds a Loki push API request with one stream per log level
+func (s *Shipper) encodeLoki(batch []shippedEntry) ([]byte, error) {
+	streams := map[string]*lokiStream{}
+	order := []string{}
+	for _, e := range batch {
+		stream, ok := streams[e.Level]
+		if !ok {
+			labels := map[string]string{"level": e.Level}
+			for k, v := range s.cfg.ShipLabels {
+				labels[k] = v
+			}
+			stream = &lokiStream{Stream: labels}
+			streams[e.Level] = stream
+			order = append(order, e.Level)
+		}
+
+		line, err := json.Marshal(e.toMap())
+		if err != nil {
+			return nil, err
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(e.Time.UnixNano(), 10), string(line)})
+	}
+
+	push := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, level := range order {
+		push.Streams = append(push.Streams, streams[level])
+	}
+
+	return json.Marshal(push)
+}
@@ -0,0 +1,299 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type shippedRequest struct {
+	auth string
+	body []byte
+}
+
+// collector is a stand-in for the log ingestion endpoint, statuses are returned in order and 204 afterwards
+type collector struct {
+	server   *httptest.Server
+	requests chan shippedRequest
+	attempts atomic.Int32
+}
+
+func newCollector(t *testing.T, statuses ...int) *collector {
+	t.Helper()
+
+	c := &collector{requests: make(chan shippedRequest, 100)}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempt := int(c.attempts.Add(1))
+		if attempt <= len(statuses) && statuses[attempt-1] >= 300 {
+			w.WriteHeader(statuses[attempt-1])
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		c.requests <- shippedRequest{auth: r.Header.Get("Authorization"), body: body}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(c.server.Close)
+
+	return c
+}
+
+func (c *collector) next(t *testing.T, timeout time.Duration) shippedRequest {
+	t.Helper()
+
+	select {
+	case req := <-c.requests:
+		return req
+	case <-time.After(timeout):
+		t.Fatalf("no logs were shipped within %s", timeout)
+		return shippedRequest{}
+	}
+}
+
+func (c *collector) expectNone(t *testing.T, wait time.Duration) {
+	t.Helper()
+
+	select {
+	case req := <-c.requests:
+		t.Fatalf("unexpected request: %s", req.body)
+	case <-time.After(wait):
+	}
+}
+
+func testShipConfig(url string) *Config {
+	return &Config{
+		LogKey:        "secret",
+		ShipURL:       url,
+		ShipFormat:    ShipFormatJSON,
+		ShipLabels:    map[string]string{"app": "certmanager"},
+		ShipBatchSize: 100,
+		ShipInterval:  time.Hour,
+		ShipQueueSize: 100,
+		ShipRetries:   3,
+		ShipTimeout:   time.Second,
+	}
+}
+
+func fire(t *testing.T, s *Shipper, level logrus.Level, msg string, fields logrus.Fields) {
+	t.Helper()
+
+	entry := logrus.NewEntry(logrus.New()).WithFields(fields)
+	entry.Time = time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	entry.Level = level
+	entry.Message = msg
+	if err := s.Fire(entry); err != nil {
+		t.Fatalf("Fire() error = %v", err)
+	}
+}
+
+func closeShipper(t *testing.T, s *Shipper) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+}
+
+func decodeJSONBatch(t *testing.T, body []byte) []map[string]interface{} {
+	t.Helper()
+
+	var entries []map[string]interface{}
+	if err := json.Unmarshal(body, &entries); err != nil {
+		t.Fatalf("body is not a JSON array of entries: %v: %s", err, body)
+	}
+
+	return entries
+}
+
+func TestShipperSendsFullBatches(t *testing.T) {
+	c := newCollector(t)
+	cfg := testShipConfig(c.server.URL)
+	cfg.ShipBatchSize = 2
+	s := NewShipper(cfg, nil)
+	s.Start()
+
+	fire(t, s, logrus.InfoLevel, "first", logrus.Fields{FieldDomain: "example.com"})
+	fire(t, s, logrus.WarnLevel, "second", nil)
+	fire(t, s, logrus.InfoLevel, "third", nil)
+
+	req := c.next(t, time.Second)
+	if req.auth != "Bearer secret" {
+		t.Errorf("Authorization = %q, want %q", req.auth, "Bearer secret")
+	}
+	entries := decodeJSONBatch(t, req.body)
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries in the batch, want 2", len(entries))
+	}
+	if entries[0]["msg"] != "first" || entries[0]["level"] != "info" || entries[0][FieldDomain] != "example.com" {
+		t.Errorf("unexpected first entry %v", entries[0])
+	}
+	if entries[0]["time"] != "2026-01-10T12:00:00Z" {
+		t.Errorf("time = %v, want 2026-01-10T12:00:00Z", entries[0]["time"])
+	}
+	if entries[1]["msg"] != "second" || entries[1]["level"] != "warning" {
+		t.Errorf("unexpected second entry %v", entries[1])
+	}
+
+	// the incomplete batch waits for the interval
+	c.expectNone(t, 100*time.Millisecond)
+
+	closeShipper(t, s)
+	entries = decodeJSONBatch(t, c.next(t, time.Second).body)
+	if len(entries) != 1 || entries[0]["msg"] != "third" {
+		t.Errorf("Close() flushed %v, want the third entry", entries)
+	}
+}
+
+func TestShipperFlushesOnInterval(t *testing.T) {
+	c := newCollector(t)
+	cfg := testShipConfig(c.server.URL)
+	cfg.ShipInterval = 50 * time.Millisecond
+	s := NewShipper(cfg, nil)
+	s.Start()
+	defer closeShipper(t, s)
+
+	fire(t, s, logrus.InfoLevel, "lonely", nil)
+
+	entries := decodeJSONBatch(t, c.next(t, time.Second).body)
+	if len(entries) != 1 || entries[0]["msg"] != "lonely" {
+		t.Errorf("got %v, want the single entry", entries)
+	}
+}
+
+func TestShipperWithoutKey(t *testing.T) {
+	c := newCollector(t)
+	cfg := testShipConfig(c.server.URL)
+	cfg.LogKey = ""
+	s := NewShipper(cfg, nil)
+	s.Start()
+
+	fire(t, s, logrus.InfoLevel, "anonymous", nil)
+	closeShipper(t, s)
+
+	if req := c.next(t, time.Second); req.auth != "" {
+		t.Errorf("Authorization = %q, want none", req.auth)
+	}
+}
+
+func TestShipperLokiFormat(t *testing.T) {
+	c := newCollector(t)
+	cfg := testShipConfig(c.server.URL)
+	cfg.ShipFormat = ShipFormatLoki
+	s := NewShipper(cfg, nil)
+	s.Start()
+
+	fire(t, s, logrus.InfoLevel, "renewed", logrus.Fields{FieldSecret: "web-tls"})
+	fire(t, s, logrus.ErrorLevel, "failed", nil)
+	fire(t, s, logrus.InfoLevel, "done", nil)
+	closeShipper(t, s)
+
+	var push struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	body := c.next(t, time.Second).body
+	if err := json.Unmarshal(body, &push); err != nil {
+		t.Fatalf("body is not a Loki push request: %v: %s", err, body)
+	}
+	if len(push.Streams) != 2 {
+		t.Fatalf("got %d streams, want one per level: %s", len(push.Streams), body)
+	}
+
+	info, errs := push.Streams[0], push.Streams[1]
+	if info.Stream["level"] != "info" || info.Stream["app"] != "certmanager" {
+		t.Errorf("info stream labels = %v", info.Stream)
+	}
+	if errs.Stream["level"] != "error" || len(errs.Values) != 1 {
+		t.Errorf("error stream = %v", errs)
+	}
+	if len(info.Values) != 2 {
+		t.Fatalf("got %d info lines, want 2", len(info.Values))
+	}
+
+	wantTimestamp := "1768046400000000000"
+	if info.Values[0][0] != wantTimestamp {
+		t.Errorf("timestamp = %s, want %s nanoseconds", info.Values[0][0], wantTimestamp)
+	}
+	line := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(info.Values[0][1]), &line); err != nil {
+		t.Fatalf("log line is not JSON: %v", err)
+	}
+	if line["msg"] != "renewed" || line[FieldSecret] != "web-tls" {
+		t.Errorf("log line = %v", line)
+	}
+}
+
+func TestShipperRetriesServerErrors(t *testing.T) {
+	c := newCollector(t, http.StatusServiceUnavailable, http.StatusInternalServerError)
+	cfg := testShipConfig(c.server.URL)
+	cfg.ShipBatchSize = 1
+	s := NewShipper(cfg, nil)
+	s.Start()
+	defer closeShipper(t, s)
+
+	fire(t, s, logrus.InfoLevel, "persistent", nil)
+
+	entries := decodeJSONBatch(t, c.next(t, 5*time.Second).body)
+	if len(entries) != 1 || entries[0]["msg"] != "persistent" {
+		t.Errorf("got %v, want the retried entry", entries)
+	}
+	if attempts := c.attempts.Load(); attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+	if dropped := s.Dropped(); dropped != 0 {
+		t.Errorf("Dropped() = %d, want 0", dropped)
+	}
+}
+
+func TestShipperDropsBatchAfterRetries(t *testing.T) {
+	c := newCollector(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	cfg := testShipConfig(c.server.URL)
+	cfg.ShipRetries = 1
+	s := NewShipper(cfg, nil)
+	s.Start()
+
+	fire(t, s, logrus.InfoLevel, "lost", nil)
+	fire(t, s, logrus.InfoLevel, "lost too", nil)
+	closeShipper(t, s)
+
+	if attempts := c.attempts.Load(); attempts != 2 {
+		t.Errorf("got %d attempts, want 2", attempts)
+	}
+	if dropped := s.Dropped(); dropped != 2 {
+		t.Errorf("Dropped() = %d, want 2", dropped)
+	}
+}
+
+func TestShipperFireNeverBlocks(t *testing.T) {
+	cfg := testShipConfig("http://127.0.0.1:0")
+	cfg.ShipQueueSize = 2
+	// not started, so nothing drains the queue
+	s := NewShipper(cfg, nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			fire(t, s, logrus.InfoLevel, "flood", nil)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Fire() blocked on a full queue")
+	}
+	if dropped := s.Dropped(); dropped != 3 {
+		t.Errorf("Dropped() = %d, want 3", dropped)
+	}
+}
@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"github.com/kelseyhightower/envconfig"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type Config struct {
+	// Port of the /metrics endpoint, metrics are not served if it's 0
+	Port int `envconfig:"PORT" default:"0"`
+}
+
+func LoadConfig() (cfg *Config, err error) {
+	cfg = new(Config)
+	err = envconfig.Process("metrics", cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load metrics config")
+	}
+
+	logrus.Infof("loaded metrics config: %+v", cfg)
+
+	return cfg, nil
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+var (
+	SecretExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "certmanager",
+		Name:      "tls_secret_expiry_timestamp_seconds",
+		Help:      "NotAfter of the certificate stored in a TLS secret as a unix timestamp.",
+	}, []string{"namespace", "secret", "managed"})
+
+	SecretExpiring = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "certmanager",
+		Name:      "tls_secret_expiring",
+		Help:      "1 if the certificate stored in a TLS secret expires within the scanner warning window.",
+	}, []string{"namespace", "secret", "managed"})
+
+	SecretInvalid = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "certmanager",
+		Name:      "tls_secret_invalid",
+		Help:      "1 if a TLS secret doesn't contain a parsable certificate.",
+	}, []string{"namespace", "secret", "managed"})
+
+	ScanTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "certmanager",
+		Name:      "tls_secret_scan_timestamp_seconds",
+		Help:      "Time of the last successful TLS secret scan as a unix timestamp.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(SecretExpiry, SecretExpiring, SecretInvalid, ScanTimestamp)
+}
+
+// Serve exposes the /metrics endpoint until the context is cancelled
+func Serve(ctx context.Context, cfg *Config) {
+	if cfg.Port == 0 {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	addr := fmt.Sprintf(":%d", cfg.Port)
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	go func() {
+		logrus.Infof("Starting metrics server on %s", addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("Metrics server error: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logrus.Errorf("Failed to shut down metrics server: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Channel interface {
+	Name() string
+	Send(ctx context.Context, event Event) error
+}
+
+// Webhook posts the event as JSON, with a secret set the payload is signed with HMAC-SHA256
+// over the "<timestamp>.<body>" string, the signature is sent in the X-Certmanager-Signature header
+type Webhook struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func (w *Webhook) Name() string {
+	return "webhook"
+}
+
+func (w *Webhook) Send(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal webhook payload")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if w.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(w.Secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+
+		req.Header.Set("X-Certmanager-Timestamp", timestamp)
+		req.Header.Set("X-Certmanager-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	return doRequest(w.Client, req)
+}
+
+// Slack posts a text message which is understood by Slack and Microsoft Teams incoming webhooks
+type Slack struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *Slack) Name() string {
+	return "slack"
+}
+
+func (s *Slack) Send(ctx context.Context, event Event) error {
+	body, err := json.Marshal(map[string]string{
+		"text": fmt.Sprintf("[certmanager] %s", event.Summary()),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal slack payload")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create slack request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return doRequest(s.Client, req)
+}
+
+func doRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to send request to %s", req.URL.Host)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("unexpected response status %d from %s: %s", resp.StatusCode, req.URL.Host, string(respBody))
+	}
+
+	return nil
+}
+
+// SMTP sends the event as a plain text email
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+func (s *SMTP) Name() string {
+	return "smtp"
+}
+
+func (s *SMTP) Send(_ context.Context, event Event) error {
+	if len(s.To) == 0 {
+		return errors.New("no email recipients configured")
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + s.From,
+		"To: " + strings.Join(s.To, ", "),
+		"Subject: [certmanager] " + string(event.Type) + " " + event.Target(),
+		"Date: " + event.Time.Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		event.Summary(),
+		"",
+	}, "\r\n")
+
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	err := smtp.SendMail(addr, auth, s.From, s.To, []byte(msg))
+	if err != nil {
+		return errors.Wrapf(err, "failed to send email via %s", addr)
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package notify
+
+import (
+	"github.com/kelseyhightower/envconfig"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+type Config struct {
+	WebhookURL string `envconfig:"WEBHOOK_URL"`
+	// WebhookSecret is used to sign webhook payloads with HMAC-SHA256
+	WebhookSecret string   `envconfig:"WEBHOOK_SECRET"`
+	SlackURL      string   `envconfig:"SLACK_URL"`
+	SMTPHost      string   `envconfig:"SMTP_HOST"`
+	SMTPPort      int      `envconfig:"SMTP_PORT" default:"587"`
+	SMTPUsername  string   `envconfig:"SMTP_USERNAME"`
+	SMTPPassword  string   `envconfig:"SMTP_PASSWORD"`
+	SMTPFrom      string   `envconfig:"SMTP_FROM"`
+	SMTPTo        []string `envconfig:"SMTP_TO"`
+	// ExpiryDays is the number of days before expiry when the expiring certificate notification is sent
+	ExpiryDays int `envconfig:"EXPIRY_DAYS" default:"14"`
+	// DedupInterval suppresses repeated notifications about the same problem
+	DedupInterval time.Duration `envconfig:"DEDUP_INTERVAL" default:"24h"`
+	Timeout       time.Duration `envconfig:"TIMEOUT" default:"10s"`
+}
+
+func LoadConfig() (cfg *Config, err error) {
+	cfg = new(Config)
+	err = envconfig.Process("notify", cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load notify config")
+	}
+
+	// the config contains credentials, so only non sensitive settings are logged
+	logrus.Infof(
+		"loaded notify config: webhook: %v, slack: %v, smtp: %v, expiry days: %d, dedup interval: %s",
+		cfg.WebhookURL != "",
+		cfg.SlackURL != "",
+		cfg.SMTPHost != "",
+		cfg.ExpiryDays,
+		cfg.DedupInterval,
+	)
+
+	return cfg, nil
+}
@@ -0,0 +1,78 @@
+package notify
+
+import (
+	"fmt"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventIssueFailed EventType = "issue_failed"
+	EventWriteFailed EventType = "write_failed"
+	EventExpiring    EventType = "expiring"
+	EventRenewed     EventType = "renewed"
+	EventRevoked     EventType = "revoked"
+)
+
+type Event struct {
+	Type      EventType `json:"type"`
+	Namespace string    `json:"namespace"`
+	Secret    string    `json:"secret"`
+	Domain    string    `json:"domain"`
+	// Path is the certificate file of tasks writing files instead of a secret
+	Path     string    `json:"path,omitempty"`
+	Message  string    `json:"message"`
+	NotAfter time.Time `json:"notAfter,omitempty"`
+	// BackupPath is set if the certificate was backed up after a failed secret write
+	BackupPath string    `json:"backupPath,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// Summary is a single line human readable description of the event
+func (e Event) Summary() string {
+	target := fmt.Sprintf("%s (%s)", e.Target(), e.Domain)
+
+	switch e.Type {
+	case EventIssueFailed:
+		return fmt.Sprintf("Certificate issuance failed for %s: %s", target, e.Message)
+	case EventWriteFailed:
+		summary := fmt.Sprintf("Failed to write certificate %s: %s", target, e.Message)
+		if e.BackupPath != "" {
+			summary += fmt.Sprintf(", certificate was backed up to %s", e.BackupPath)
+		}
+		return summary
+	case EventExpiring:
+		return fmt.Sprintf(
+			"Certificate %s expires in %d days at %s",
+			target,
+			int(time.Until(e.NotAfter).Hours()/24),
+			e.NotAfter.UTC().Format(time.RFC3339),
+		)
+	case EventRenewed:
+		return fmt.Sprintf("Certificate %s was renewed, it expires at %s", target, e.NotAfter.UTC().Format(time.RFC3339))
+	case EventRevoked:
+		return fmt.Sprintf("Certificate %s was revoked, reissuing it: %s", target, e.Message)
+	default:
+		return fmt.Sprintf("%s for %s: %s", e.Type, target, e.Message)
+	}
+}
+
+// Target is the secret in namespace/name form or the certificate file path
+func (e Event) Target() string {
+	if e.Path != "" {
+		return e.Path
+	}
+
+	return e.Namespace + "/" + e.Secret
+}
+
+// dedupKey identifies the problem the event reports, events with the same key are sent once per dedup interval
+func (e Event) dedupKey() string {
+	key := fmt.Sprintf("%s|%s|%s|%s", e.Type, e.Namespace, e.Secret, e.Path)
+	if e.Type == EventExpiring || e.Type == EventRenewed {
+		key += "|" + e.NotAfter.UTC().Format(time.RFC3339)
+	}
+
+	return key
+}
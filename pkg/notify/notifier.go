@@ -0,0 +1,147 @@
+package notify
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TaskConfig adds channels and overrides global settings for a single certificate task
+type TaskConfig struct {
+	WebhookURL string   `json:"WebhookURL,omitempty"`
+	SlackURL   string   `json:"SlackURL,omitempty"`
+	EmailTo    []string `json:"EmailTo,omitempty"`
+	ExpiryDays int      `json:"ExpiryDays,omitempty"`
+}
+
+type Notifier struct {
+	cfg      *Config
+	client   *http.Client
+	channels []Channel
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+func NewNotifier(cfg *Config) *Notifier {
+	n := &Notifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		sent:   map[string]time.Time{},
+	}
+
+	if cfg.WebhookURL != "" {
+		n.channels = append(n.channels, &Webhook{URL: cfg.WebhookURL, Secret: cfg.WebhookSecret, Client: n.client})
+	}
+	if cfg.SlackURL != "" {
+		n.channels = append(n.channels, &Slack{URL: cfg.SlackURL, Client: n.client})
+	}
+	if cfg.SMTPHost != "" && len(cfg.SMTPTo) > 0 {
+		n.channels = append(n.channels, n.smtp(cfg.SMTPTo))
+	}
+
+	return n
+}
+
+func (n *Notifier) smtp(to []string) *SMTP {
+	return &SMTP{
+		Host:     n.cfg.SMTPHost,
+		Port:     n.cfg.SMTPPort,
+		Username: n.cfg.SMTPUsername,
+		Password: n.cfg.SMTPPassword,
+		From:     n.cfg.SMTPFrom,
+		To:       to,
+	}
+}
+
+// ExpiryThreshold returns how long before the expiry the expiring notification should be sent
+func (n *Notifier) ExpiryThreshold(taskCfg *TaskConfig) time.Duration {
+	days := n.cfg.ExpiryDays
+	if taskCfg != nil && taskCfg.ExpiryDays > 0 {
+		days = taskCfg.ExpiryDays
+	}
+
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Notify sends the event to the global channels and the ones configured for the task,
+// events reporting the same problem are sent once per dedup interval
+func (n *Notifier) Notify(ctx context.Context, event Event, taskCfg *TaskConfig) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	if event.Type == EventRenewed {
+		n.resolve(event)
+	}
+
+	if !n.shouldSend(event) {
+		logrus.Debugf("skipping duplicate notification: %s", event.Summary())
+		return
+	}
+
+	channels := append([]Channel{}, n.channels...)
+	channels = append(channels, n.taskChannels(taskCfg)...)
+	if len(channels) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, n.cfg.Timeout)
+	defer cancel()
+
+	for _, ch := range channels {
+		if err := ch.Send(ctx, event); err != nil {
+			logrus.WithError(err).Errorf("failed to send %s notification via %s", event.Type, ch.Name())
+			continue
+		}
+		logrus.Debugf("sent %s notification via %s", event.Type, ch.Name())
+	}
+}
+
+func (n *Notifier) taskChannels(taskCfg *TaskConfig) []Channel {
+	if taskCfg == nil {
+		return nil
+	}
+
+	channels := []Channel{}
+	if taskCfg.WebhookURL != "" {
+		channels = append(channels, &Webhook{URL: taskCfg.WebhookURL, Secret: n.cfg.WebhookSecret, Client: n.client})
+	}
+	if taskCfg.SlackURL != "" {
+		channels = append(channels, &Slack{URL: taskCfg.SlackURL, Client: n.client})
+	}
+	if n.cfg.SMTPHost != "" && len(taskCfg.EmailTo) > 0 {
+		channels = append(channels, n.smtp(taskCfg.EmailTo))
+	}
+
+	return channels
+}
+
+func (n *Notifier) shouldSend(event Event) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	key := event.dedupKey()
+	if last, ok := n.sent[key]; ok && event.Time.Sub(last) < n.cfg.DedupInterval {
+		return false
+	}
+	n.sent[key] = event.Time
+
+	return true
+}
+
+// resolve forgets failures of the renewed secret, so a new failure is reported immediately
+func (n *Notifier) resolve(event Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	suffix := "|" + event.Namespace + "|" + event.Secret
+	for key := range n.sent {
+		if strings.HasSuffix(key, suffix) || strings.Contains(key, suffix+"|") {
+			delete(n.sent, key)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package revocation
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusGood    Status = "good"
+	StatusRevoked Status = "revoked"
+	StatusUnknown Status = "unknown"
+
+	SourceOCSP = "ocsp"
+	SourceCRL  = "crl"
+
+	// defaultCacheTTL is used for responses without the next update time
+	defaultCacheTTL = time.Hour
+	maxResponseSize = 10 << 20
+)
+
+type Result struct {
+	Status    Status
+	Source    string
+	RevokedAt time.Time
+	// Reason is the RFC 5280 revocation reason code
+	Reason     int
+	NextUpdate time.Time
+}
+
+type cacheEntry struct {
+	result    *Result
+	expiresAt time.Time
+}
+
+type crlEntry struct {
+	list      *x509.RevocationList
+	expiresAt time.Time
+}
+
+// Checker looks up revocation status of certificates using OCSP responders and CRL distribution points
+// listed in the certificates, responses are cached until their next update time
+type Checker struct {
+	client *http.Client
+	now    func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+	crls  map[string]crlEntry
+}
+
+func NewChecker(client *http.Client) *Checker {
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	return &Checker{
+		client: client,
+		now:    time.Now,
+		cache:  map[string]cacheEntry{},
+		crls:   map[string]crlEntry{},
+	}
+}
+
+// Check returns the revocation status of the certificate, OCSP is tried first and CRLs are used as a fallback
+func (c *Checker) Check(ctx context.Context, cert, issuer *x509.Certificate) (*Result, error) {
+	if issuer == nil {
+		return nil, errors.New("issuer certificate is required for revocation checks")
+	}
+
+	cacheKey := string(issuer.RawSubjectPublicKeyInfo) + "|" + cert.SerialNumber.String()
+	if res := c.cached(cacheKey); res != nil {
+		return res, nil
+	}
+
+	var lastErr error
+	for _, server := range cert.OCSPServer {
+		res, err := c.checkOCSP(ctx, server, cert, issuer)
+		if err != nil {
+			logrus.Debugf("OCSP check via %s failed: %v", server, err)
+			lastErr = err
+			continue
+		}
+		if res.Status == StatusUnknown {
+			continue
+		}
+		c.store(cacheKey, res)
+		return res, nil
+	}
+
+	for _, url := range cert.CRLDistributionPoints {
+		res, err := c.checkCRL(ctx, url, cert, issuer)
+		if err != nil {
+			logrus.Debugf("CRL check via %s failed: %v", url, err)
+			lastErr = err
+			continue
+		}
+		c.store(cacheKey, res)
+		return res, nil
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+
+	return &Result{Status: StatusUnknown}, nil
+}
+
+// CheckPEM checks the leaf certificate of a PEM chain, the issuer is taken from the next certificate in the chain
+func (c *Checker) CheckPEM(ctx context.Context, chainPEM []byte) (*Result, error) {
+	certs := []*x509.Certificate{}
+	for rest := chainPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse certificate chain")
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found in the chain")
+	}
+	if len(certs) < 2 {
+		return nil, errors.New("certificate chain contains no issuer certificate")
+	}
+
+	return c.Check(ctx, certs[0], certs[1])
+}
+
+func (c *Checker) checkOCSP(ctx context.Context, server string, cert, issuer *x509.Certificate) (*Result, error) {
+	reqBody, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create OCSP request")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create OCSP HTTP request")
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	body, err := c.fetch(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse OCSP response")
+	}
+
+	res := &Result{
+		Source:     SourceOCSP,
+		NextUpdate: resp.NextUpdate,
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		res.Status = StatusGood
+	case ocsp.Revoked:
+		res.Status = StatusRevoked
+		res.RevokedAt = resp.RevokedAt
+		res.Reason = resp.RevocationReason
+	default:
+		res.Status = StatusUnknown
+	}
+
+	return res, nil
+}
+
+func (c *Checker) checkCRL(ctx context.Context, url string, cert, issuer *x509.Certificate) (*Result, error) {
+	list, err := c.loadCRL(ctx, url, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{
+		Status:     StatusGood,
+		Source:     SourceCRL,
+		NextUpdate: list.NextUpdate,
+	}
+	for _, entry := range list.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			res.Status = StatusRevoked
+			res.RevokedAt = entry.RevocationTime
+			res.Reason = entry.ReasonCode
+			break
+		}
+	}
+
+	return res, nil
+}
+
+func (c *Checker) loadCRL(ctx context.Context, url string, issuer *x509.Certificate) (*x509.RevocationList, error) {
+	c.mu.Lock()
+	entry, ok := c.crls[url]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expiresAt) {
+		return entry.list, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create CRL request")
+	}
+
+	body, err := c.fetch(req)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := x509.ParseRevocationList(body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse CRL from %s", url)
+	}
+	if err := list.CheckSignatureFrom(issuer); err != nil {
+		return nil, errors.Wrapf(err, "CRL from %s is not signed by the certificate issuer", url)
+	}
+
+	c.mu.Lock()
+	c.crls[url] = crlEntry{list: list, expiresAt: c.expiry(list.NextUpdate)}
+	c.mu.Unlock()
+
+	return list, nil
+}
+
+func (c *Checker) fetch(req *http.Request) ([]byte, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to request %s", req.URL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected response status %d from %s", resp.StatusCode, req.URL)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read response from %s", req.URL)
+	}
+
+	return body, nil
+}
+
+func (c *Checker) cached(key string) *Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.cache[key]
+	if !ok {
+		return nil
+	}
+	if !c.now().Before(entry.expiresAt) {
+		delete(c.cache, key)
+		return nil
+	}
+
+	return entry.result
+}
+
+func (c *Checker) store(key string, res *Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cache[key] = cacheEntry{result: res, expiresAt: c.expiry(res.NextUpdate)}
+}
+
+// expiry returns until when a response can be cached, responses without the next update time are cached for an hour
+func (c *Checker) expiry(nextUpdate time.Time) time.Time {
+	if nextUpdate.IsZero() || nextUpdate.Before(c.now()) {
+		return c.now().Add(defaultCacheTTL)
+	}
+
+	return nextUpdate
+}
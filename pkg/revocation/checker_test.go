@@ -0,0 +1,338 @@
+package revocation
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             testNow.Add(-24 * time.Hour),
+		NotAfter:              testNow.Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) leaf(t *testing.T, serial int64, ocspURL, crlURL string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    testNow.Add(-time.Hour),
+		NotAfter:     testNow.Add(90 * 24 * time.Hour),
+	}
+	if ocspURL != "" {
+		template.OCSPServer = []string{ocspURL}
+	}
+	if crlURL != "" {
+		template.CRLDistributionPoints = []string{crlURL}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// ocspResponder answers every request with the given status signed by the CA and counts the requests
+func (ca *testCA) ocspResponder(t *testing.T, status int, nextUpdate time.Time, hits *int32) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		template := ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   testNow.Add(-time.Hour),
+			NextUpdate:   nextUpdate,
+		}
+		if status == ocsp.Revoked {
+			template.RevokedAt = testNow.Add(-30 * time.Minute)
+			template.RevocationReason = ocsp.KeyCompromise
+		}
+		resp, err := ocsp.CreateResponse(ca.cert, ca.cert, template, ca.key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		_, _ = w.Write(resp)
+	}))
+}
+
+// crlServer serves a CRL signed by the CA listing the revoked serials and counts the requests
+func (ca *testCA) crlServer(t *testing.T, revoked []int64, nextUpdate time.Time, hits *int32) *httptest.Server {
+	t.Helper()
+
+	entries := make([]x509.RevocationListEntry, 0, len(revoked))
+	for _, serial := range revoked {
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: testNow.Add(-2 * time.Hour),
+			ReasonCode:     ocsp.Superseded,
+		})
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                testNow.Add(-time.Hour),
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		_, _ = w.Write(crl)
+	}))
+}
+
+func newTestChecker(client *http.Client, now *time.Time) *Checker {
+	c := NewChecker(client)
+	c.now = func() time.Time {
+		return *now
+	}
+
+	return c
+}
+
+func TestCheckOCSP(t *testing.T) {
+	tests := []struct {
+		name       string
+		ocspStatus int
+		want       Status
+		wantSource string
+	}{
+		{name: "good", ocspStatus: ocsp.Good, want: StatusGood, wantSource: SourceOCSP},
+		{name: "revoked", ocspStatus: ocsp.Revoked, want: StatusRevoked, wantSource: SourceOCSP},
+		{name: "unknown", ocspStatus: ocsp.Unknown, want: StatusUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ca := newTestCA(t)
+			var hits int32
+			responder := ca.ocspResponder(t, tt.ocspStatus, testNow.Add(time.Hour), &hits)
+			defer responder.Close()
+
+			now := testNow
+			checker := newTestChecker(responder.Client(), &now)
+
+			res, err := checker.Check(context.Background(), ca.leaf(t, 100, responder.URL, ""), ca.cert)
+			if err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			if res.Status != tt.want {
+				t.Errorf("Status = %s, want %s", res.Status, tt.want)
+			}
+			if res.Source != tt.wantSource {
+				t.Errorf("Source = %q, want %q", res.Source, tt.wantSource)
+			}
+			if hits != 1 {
+				t.Errorf("responder got %d requests, want 1", hits)
+			}
+			if tt.want == StatusRevoked {
+				if res.Reason != ocsp.KeyCompromise {
+					t.Errorf("Reason = %d, want %d", res.Reason, ocsp.KeyCompromise)
+				}
+				if !res.RevokedAt.Equal(testNow.Add(-30 * time.Minute)) {
+					t.Errorf("RevokedAt = %s, want %s", res.RevokedAt, testNow.Add(-30*time.Minute))
+				}
+			}
+		})
+	}
+}
+
+func TestCheckOCSPCacheRespectsNextUpdate(t *testing.T) {
+	ca := newTestCA(t)
+	var hits int32
+	nextUpdate := testNow.Add(2 * time.Hour)
+	responder := ca.ocspResponder(t, ocsp.Good, nextUpdate, &hits)
+	defer responder.Close()
+
+	now := testNow
+	checker := newTestChecker(responder.Client(), &now)
+	leaf := ca.leaf(t, 100, responder.URL, "")
+
+	check := func(wantHits int32) {
+		t.Helper()
+		res, err := checker.Check(context.Background(), leaf, ca.cert)
+		if err != nil {
+			t.Fatalf("Check() error = %v", err)
+		}
+		if res.Status != StatusGood {
+			t.Fatalf("Status = %s, want %s", res.Status, StatusGood)
+		}
+		if got := atomic.LoadInt32(&hits); got != wantHits {
+			t.Fatalf("responder got %d requests, want %d", got, wantHits)
+		}
+	}
+
+	check(1)
+
+	now = nextUpdate.Add(-time.Second)
+	check(1)
+
+	now = nextUpdate
+	check(2)
+}
+
+func TestCheckUnknownOCSPFallsBackToCRL(t *testing.T) {
+	ca := newTestCA(t)
+	var ocspHits, crlHits int32
+	responder := ca.ocspResponder(t, ocsp.Unknown, testNow.Add(time.Hour), &ocspHits)
+	defer responder.Close()
+	crls := ca.crlServer(t, []int64{100}, testNow.Add(time.Hour), &crlHits)
+	defer crls.Close()
+
+	now := testNow
+	checker := newTestChecker(responder.Client(), &now)
+
+	res, err := checker.Check(context.Background(), ca.leaf(t, 100, responder.URL, crls.URL), ca.cert)
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if res.Status != StatusRevoked || res.Source != SourceCRL {
+		t.Errorf("got %s from %q, want %s from %q", res.Status, res.Source, StatusRevoked, SourceCRL)
+	}
+	if ocspHits != 1 || crlHits != 1 {
+		t.Errorf("got %d OCSP and %d CRL requests, want 1 each", ocspHits, crlHits)
+	}
+}
+
+func TestCheckCRL(t *testing.T) {
+	ca := newTestCA(t)
+	var hits int32
+	nextUpdate := testNow.Add(6 * time.Hour)
+	crls := ca.crlServer(t, []int64{200}, nextUpdate, &hits)
+	defer crls.Close()
+
+	now := testNow
+	checker := newTestChecker(crls.Client(), &now)
+
+	revoked, err := checker.Check(context.Background(), ca.leaf(t, 200, "", crls.URL), ca.cert)
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if revoked.Status != StatusRevoked {
+		t.Errorf("Status = %s, want %s", revoked.Status, StatusRevoked)
+	}
+	if revoked.Reason != ocsp.Superseded {
+		t.Errorf("Reason = %d, want %d", revoked.Reason, ocsp.Superseded)
+	}
+	if !revoked.NextUpdate.Equal(nextUpdate) {
+		t.Errorf("NextUpdate = %s, want %s", revoked.NextUpdate, nextUpdate)
+	}
+
+	good, err := checker.Check(context.Background(), ca.leaf(t, 201, "", crls.URL), ca.cert)
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if good.Status != StatusGood {
+		t.Errorf("Status = %s, want %s", good.Status, StatusGood)
+	}
+	if hits != 1 {
+		t.Errorf("CRL was downloaded %d times before its next update, want 1", hits)
+	}
+
+	now = nextUpdate
+	if _, err := checker.Check(context.Background(), ca.leaf(t, 202, "", crls.URL), ca.cert); err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if hits != 2 {
+		t.Errorf("CRL was downloaded %d times after its next update, want 2", hits)
+	}
+}
+
+func TestCheckCRLFromOtherIssuer(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	var hits int32
+	crls := other.crlServer(t, nil, testNow.Add(time.Hour), &hits)
+	defer crls.Close()
+
+	now := testNow
+	checker := newTestChecker(crls.Client(), &now)
+
+	if _, err := checker.Check(context.Background(), ca.leaf(t, 300, "", crls.URL), ca.cert); err == nil {
+		t.Error("Check() accepted a CRL not signed by the certificate issuer")
+	}
+}
+
+func TestCheckWithoutRevocationInfo(t *testing.T) {
+	ca := newTestCA(t)
+	now := testNow
+	checker := newTestChecker(nil, &now)
+
+	res, err := checker.Check(context.Background(), ca.leaf(t, 400, "", ""), ca.cert)
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if res.Status != StatusUnknown {
+		t.Errorf("Status = %s, want %s", res.Status, StatusUnknown)
+	}
+}
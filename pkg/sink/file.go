@@ -0,0 +1,509 @@
+package sink
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/breathbath/certmanager/pkg/backup"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/pkg/errors"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCertMode         = 0o644
+	defaultKeyMode          = 0o600
+	defaultPostRenewTimeout = 30 * time.Second
+	// fileBackupNamespace is the namespace in backups of certificates which couldn't be written to files
+	fileBackupNamespace = "files"
+)
+
+// FileConfig describes certificate files written on the local filesystem, e.g. for nginx on a plain host
+type FileConfig struct {
+	// Cert is the path of the leaf certificate
+	Cert string `json:"Cert"`
+	// Key is the path of the private key
+	Key string `json:"Key"`
+	// Chain is the path of the issuer certificates without the leaf, it's not written if empty
+	Chain string `json:"Chain,omitempty"`
+	// Fullchain is the path of the leaf followed by the issuer certificates, it's not written if empty
+	Fullchain string `json:"Fullchain,omitempty"`
+	// Owner and Group of the written files as names or numeric ids, the process user and group are used if empty
+	Owner string `json:"Owner,omitempty"`
+	Group string `json:"Group,omitempty"`
+	// CertMode is the octal mode of the certificate files, "0644" by default
+	CertMode string `json:"CertMode,omitempty"`
+	// KeyMode is the octal mode of the private key file, "0600" by default
+	KeyMode string `json:"KeyMode,omitempty"`
+	// PostRenewCommand is run with sh -c after new files are written, e.g. "nginx -s reload"
+	PostRenewCommand string `json:"PostRenewCommand,omitempty"`
+	// PostRenewTimeout limits the command run time, "30s" by default
+	PostRenewTimeout string `json:"PostRenewTimeout,omitempty"`
+}
+
+func (c *FileConfig) Validate() error {
+	if c.Cert == "" || c.Key == "" {
+		return errors.New("paths of Cert and Key must be set")
+	}
+
+	seen := map[string]bool{}
+	for _, path := range c.paths() {
+		if !filepath.IsAbs(path) {
+			return errors.Errorf("path %q must be absolute", path)
+		}
+		if seen[filepath.Clean(path)] {
+			return errors.Errorf("path %q is used for more than one file", path)
+		}
+		seen[filepath.Clean(path)] = true
+	}
+
+	if _, err := parseMode(c.CertMode, defaultCertMode); err != nil {
+		return errors.Wrap(err, "invalid CertMode")
+	}
+	if _, err := parseMode(c.KeyMode, defaultKeyMode); err != nil {
+		return errors.Wrap(err, "invalid KeyMode")
+	}
+	if _, err := c.postRenewTimeout(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// paths lists the configured file paths
+func (c *FileConfig) paths() []string {
+	paths := []string{c.Cert, c.Key}
+	for _, path := range []string{c.Chain, c.Fullchain} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
+func (c *FileConfig) postRenewTimeout() (time.Duration, error) {
+	if c.PostRenewTimeout == "" {
+		return defaultPostRenewTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(c.PostRenewTimeout)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid PostRenewTimeout %q", c.PostRenewTimeout)
+	}
+	if timeout <= 0 {
+		return 0, errors.New("PostRenewTimeout must be positive")
+	}
+
+	return timeout, nil
+}
+
+func parseMode(value string, fallback os.FileMode) (os.FileMode, error) {
+	if value == "" {
+		return fallback, nil
+	}
+
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, errors.Errorf("%q is not an octal file mode like 0640", value)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// FileSink writes certificates to files replacing them together with a rollback on failure
+type FileSink struct {
+	cfg     *FileConfig
+	backups *backup.Store
+	// dryRun only logs file writes and the post renewal command
+	dryRun bool
+}
+
+// NewFileSink creates a FileSink, backups can be nil if certificates which couldn't be written shouldn't be backed up
+func NewFileSink(cfg *FileConfig, backups *backup.Store, dryRun bool) *FileSink {
+	return &FileSink{cfg: cfg, backups: backups, dryRun: dryRun}
+}
+
+func (s *FileSink) String() string {
+	return "files " + s.cfg.Cert
+}
+
+// Load returns the certificate from the Cert file, nil is returned if any of the configured files is missing
+// or the certificate is unreadable, so that all files are written again
+func (s *FileSink) Load(ctx context.Context) (*x509.Certificate, error) {
+	for _, path := range s.cfg.paths() {
+		_, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			logging.FromContext(ctx).Infof("certificate file %s doesn't exist", path)
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to check certificate file %s", path)
+		}
+	}
+
+	certPEM, err := os.ReadFile(s.cfg.Cert)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read certificate file %s", s.cfg.Cert)
+	}
+
+	cert, err := ParseLeaf(certPEM)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("certificate file %s is unreadable: %v", s.cfg.Cert, err)
+		return nil, nil
+	}
+
+	keyPEM, err := os.ReadFile(s.cfg.Key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read key file %s", s.cfg.Key)
+	}
+	// a key left over from an interrupted write doesn't match the certificate, both are replaced then
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		logging.FromContext(ctx).Warnf("key file %s doesn't match certificate file %s: %v", s.cfg.Key, s.cfg.Cert, err)
+		return nil, nil
+	}
+
+	return cert, nil
+}
+
+// LoadPEM returns the stored leaf certificate followed by its issuer chain, nil is returned if the Cert file doesn't exist
+func (s *FileSink) LoadPEM() ([]byte, error) {
+	if s.cfg.Fullchain != "" {
+		return readIfExists(s.cfg.Fullchain)
+	}
+
+	certPEM, err := readIfExists(s.cfg.Cert)
+	if err != nil || certPEM == nil || s.cfg.Chain == "" {
+		return certPEM, err
+	}
+
+	chainPEM, err := readIfExists(s.cfg.Chain)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(certPEM, chainPEM...), nil
+}
+
+func readIfExists(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+
+	return data, nil
+}
+
+// rename moves the written files into place, tests replace it to fail a single rename
+var rename = os.Rename
+
+type pendingFile struct {
+	path string
+	tmp  string
+	// old is a hard link to the replaced file used to roll back, empty if the target didn't exist
+	old string
+}
+
+// Store writes all files to temporary files next to their targets first and renames them into place afterwards,
+// readers never see partially written files. The key is moved last and all files are rolled back if a rename
+// fails, so a new key never ends up next to an old certificate
+func (s *FileSink) Store(ctx context.Context, issued *Certificate) error {
+	log := logging.FromContext(ctx)
+
+	leafPEM, chainPEM, err := splitChain(issued.CertPEM)
+	if err != nil {
+		return err
+	}
+
+	certMode, _ := parseMode(s.cfg.CertMode, defaultCertMode)
+	keyMode, _ := parseMode(s.cfg.KeyMode, defaultKeyMode)
+	contents := []struct {
+		path string
+		data []byte
+		mode os.FileMode
+	}{
+		{s.cfg.Chain, chainPEM, certMode},
+		{s.cfg.Fullchain, issued.CertPEM, certMode},
+		{s.cfg.Cert, leafPEM, certMode},
+		{s.cfg.Key, issued.KeyPEM, keyMode},
+	}
+
+	if s.dryRun {
+		for _, c := range contents {
+			if c.path != "" {
+				log.Infof("dry run: would write %s with mode %04o", c.path, c.mode)
+			}
+		}
+		return nil
+	}
+
+	uid, gid, err := s.owner()
+	if err != nil {
+		return err
+	}
+
+	pending := []pendingFile{}
+	defer func() {
+		for _, p := range pending {
+			_ = os.Remove(p.tmp)
+			if p.old != "" {
+				_ = os.Remove(p.old)
+			}
+		}
+	}()
+
+	for _, c := range contents {
+		if c.path == "" {
+			continue
+		}
+		tmp, err := writeTemp(c.path, c.data, c.mode, uid, gid)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, pendingFile{path: c.path, tmp: tmp})
+
+		old, err := linkOld(c.path, tmp)
+		if err != nil {
+			return err
+		}
+		pending[len(pending)-1].old = old
+	}
+
+	for i, p := range pending {
+		if err := rename(p.tmp, p.path); err != nil {
+			rollback(ctx, pending[:i])
+			return errors.Wrapf(err, "failed to move certificate file into %s", p.path)
+		}
+		syncDir(filepath.Dir(p.path))
+	}
+
+	for _, p := range pending {
+		log.Infof("wrote %s", p.path)
+	}
+
+	return nil
+}
+
+// linkOld keeps the current target under a temporary name, so it can be restored if a later rename fails
+func linkOld(path, tmp string) (string, error) {
+	old := tmp + ".old"
+	err := os.Link(path, old)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to keep the current file %s for rollback", path)
+	}
+
+	return old, nil
+}
+
+// rollback restores the files which were already replaced, files which didn't exist before are removed
+func rollback(ctx context.Context, renamed []pendingFile) {
+	log := logging.FromContext(ctx)
+	for i := len(renamed) - 1; i >= 0; i-- {
+		p := renamed[i]
+		var err error
+		if p.old != "" {
+			err = os.Rename(p.old, p.path)
+		} else {
+			err = os.Remove(p.path)
+		}
+		if err != nil {
+			log.Errorf("failed to roll back certificate file %s: %v", p.path, err)
+			continue
+		}
+		syncDir(filepath.Dir(p.path))
+		log.Warnf("rolled back %s", p.path)
+	}
+}
+
+// BackupOnFailure writes the certificate data to the backup store named after the Cert file,
+// the backup file path or an empty string is returned
+func (s *FileSink) BackupOnFailure(ctx context.Context, issued *Certificate) string {
+	log := logging.FromContext(ctx)
+	if s.dryRun || s.backups == nil {
+		return ""
+	}
+
+	domain := ""
+	if leaf, err := ParseLeaf(issued.CertPEM); err == nil && len(leaf.DNSNames) > 0 {
+		domain = leaf.DNSNames[0]
+	}
+
+	backupFilePath, err := s.backups.Write(fileBackupNamespace, filepath.Base(s.cfg.Cert), domain, issued.CertPEM, issued.KeyPEM)
+	if err != nil {
+		log.WithError(err).Warn("failed to back up certificate data after certificate file write failure")
+		return ""
+	}
+
+	log.Infof("backed up certificate data to %s", backupFilePath)
+
+	return backupFilePath
+}
+
+// AfterStore runs the post renewal command
+func (s *FileSink) AfterStore(ctx context.Context) error {
+	command := strings.TrimSpace(s.cfg.PostRenewCommand)
+	if command == "" {
+		return nil
+	}
+
+	log := logging.FromContext(ctx)
+	if s.dryRun {
+		log.Infof("dry run: would run post renewal command %q", command)
+		return nil
+	}
+
+	timeout, err := s.cfg.postRenewTimeout()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	// don't wait for children which keep the output open after the command is killed
+	cmd.WaitDelay = 2 * time.Second
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.Errorf("post renewal command %q didn't finish within %s", command, timeout)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "post renewal command %q failed: %s", command, strings.TrimSpace(string(output)))
+	}
+
+	log.Infof("post renewal command %q succeeded: %s", command, strings.TrimSpace(string(output)))
+
+	return nil
+}
+
+// owner resolves the configured owner and group, -1 keeps the id of the process
+func (s *FileSink) owner() (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if s.cfg.Owner != "" {
+		uid, err = lookupID(s.cfg.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "unknown file owner %q", s.cfg.Owner)
+		}
+	}
+	if s.cfg.Group != "" {
+		gid, err = lookupID(s.cfg.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "unknown file group %q", s.cfg.Group)
+		}
+	}
+
+	return uid, gid, nil
+}
+
+func lookupID(value string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(value); err == nil {
+		return id, nil
+	}
+
+	id, err := lookup(value)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(id)
+}
+
+// writeTemp writes the data to a temporary file in the target directory, so it can be renamed over the target
+func writeTemp(path string, data []byte, mode os.FileMode, uid, gid int) (string, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", errors.Wrapf(err, "failed to create directory %s", dir)
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create temporary file for %s", path)
+	}
+	tmp := f.Name()
+
+	err = func() error {
+		defer f.Close()
+		if err := f.Chmod(mode); err != nil {
+			return err
+		}
+		if uid >= 0 || gid >= 0 {
+			if err := f.Chown(uid, gid); err != nil {
+				return err
+			}
+		}
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+
+		return f.Sync()
+	}()
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", errors.Wrapf(err, "failed to write temporary file for %s", path)
+	}
+
+	return tmp, nil
+}
+
+// syncDir persists the rename in the directory, errors are ignored since not all filesystems support it
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	_ = d.Sync()
+}
+
+// splitChain separates the leaf certificate from the issuer certificates
+func splitChain(certPEM []byte) (leafPEM, chainPEM []byte, err error) {
+	rest := certPEM
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		encoded := pem.EncodeToMemory(block)
+		if leafPEM == nil {
+			leafPEM = encoded
+		} else {
+			chainPEM = append(chainPEM, encoded...)
+		}
+	}
+
+	if leafPEM == nil {
+		return nil, nil, errors.New("issued certificate contains no PEM data")
+	}
+
+	return leafPEM, chainPEM, nil
+}
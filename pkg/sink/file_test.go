@@ -0,0 +1,288 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/breathbath/certmanager/pkg/backup"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testIssue is an issued certificate together with the expected file contents
+type testIssue struct {
+	issued *Certificate
+	leaf   []byte
+	chain  []byte
+}
+
+// newTestIssue creates a leaf signed by a fresh CA, the serial tells the certificates of a test apart
+func newTestIssue(t *testing.T, serial int64) *testIssue {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+
+	return &testIssue{
+		issued: &Certificate{
+			CertPEM: append(append([]byte{}, leaf...), chain...),
+			KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		},
+		leaf:  leaf,
+		chain: chain,
+	}
+}
+
+func testFileConfig(dir string) *FileConfig {
+	return &FileConfig{
+		Cert:      filepath.Join(dir, "cert.pem"),
+		Key:       filepath.Join(dir, "key.pem"),
+		Chain:     filepath.Join(dir, "chain.pem"),
+		Fullchain: filepath.Join(dir, "fullchain.pem"),
+	}
+}
+
+// failRename makes the rename into the given path fail until the end of the test
+func failRename(t *testing.T, path string) {
+	t.Helper()
+
+	rename = func(oldPath, newPath string) error {
+		if newPath == path {
+			return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: os.ErrPermission}
+		}
+		return os.Rename(oldPath, newPath)
+	}
+	t.Cleanup(func() {
+		rename = os.Rename
+	})
+}
+
+func assertFiles(t *testing.T, cfg *FileConfig, want *testIssue) {
+	t.Helper()
+
+	files := []struct {
+		path string
+		data []byte
+	}{
+		{cfg.Cert, want.leaf},
+		{cfg.Chain, want.chain},
+		{cfg.Fullchain, want.issued.CertPEM},
+		{cfg.Key, want.issued.KeyPEM},
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, f.data) {
+			t.Errorf("%s doesn't hold the expected data:\n%s", filepath.Base(f.path), data)
+		}
+	}
+}
+
+func assertNoLeftovers(t *testing.T, dir string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		switch entry.Name() {
+		case "cert.pem", "key.pem", "chain.pem", "fullchain.pem":
+		default:
+			t.Errorf("unexpected file %s is left in the directory", entry.Name())
+		}
+	}
+}
+
+func TestFileSinkStore(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testFileConfig(dir)
+	s := NewFileSink(cfg, nil, false)
+	issue := newTestIssue(t, 10)
+
+	if err := s.Store(context.Background(), issue.issued); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+
+	assertFiles(t, cfg, issue)
+	assertNoLeftovers(t, dir)
+
+	info, err := os.Stat(cfg.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != defaultKeyMode {
+		t.Errorf("key file mode = %04o, want %04o", mode, defaultKeyMode)
+	}
+
+	cert, err := s.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cert == nil || cert.SerialNumber.Int64() != 10 {
+		t.Errorf("Load() = %v, want the stored certificate", cert)
+	}
+}
+
+func TestFileSinkStoreRollsBackFailedRename(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testFileConfig(dir)
+	s := NewFileSink(cfg, nil, false)
+	old, renewed := newTestIssue(t, 10), newTestIssue(t, 11)
+
+	if err := s.Store(context.Background(), old.issued); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+
+	// the key is moved last, so the chain, fullchain and cert are already replaced when it fails
+	failRename(t, cfg.Key)
+	if err := s.Store(context.Background(), renewed.issued); err == nil {
+		t.Fatal("Store() succeeded although the key couldn't be moved into place")
+	}
+
+	assertFiles(t, cfg, old)
+	assertNoLeftovers(t, dir)
+
+	cert, err := s.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cert == nil || cert.SerialNumber.Int64() != 10 {
+		t.Errorf("Load() = %v, want the old certificate", cert)
+	}
+}
+
+func TestFileSinkStoreRemovesNewFilesOnFailedRename(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testFileConfig(dir)
+	s := NewFileSink(cfg, nil, false)
+
+	failRename(t, cfg.Key)
+	if err := s.Store(context.Background(), newTestIssue(t, 10).issued); err == nil {
+		t.Fatal("Store() succeeded although the key couldn't be moved into place")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("got %d files after the failed first write, want none", len(entries))
+	}
+}
+
+func TestFileSinkLoadRewritesMismatchedPair(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testFileConfig(dir)
+	s := NewFileSink(cfg, nil, false)
+	old, renewed := newTestIssue(t, 10), newTestIssue(t, 11)
+
+	if err := s.Store(context.Background(), old.issued); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	// a new key next to the old certificate as left by an interrupted write
+	if err := os.WriteFile(cfg.Key, renewed.issued.KeyPEM, defaultKeyMode); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := s.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cert != nil {
+		t.Fatalf("Load() = certificate %d, want nil for a key which doesn't match", cert.SerialNumber)
+	}
+
+	res, err := Ensure(context.Background(), s, Request{Domain: "example.com", RenewBefore: time.Hour}, func() (*Certificate, error) {
+		return renewed.issued, nil
+	})
+	if err != nil {
+		t.Fatalf("Ensure() error = %v", err)
+	}
+	if !res.Renewed {
+		t.Error("Ensure() didn't replace the mismatched pair")
+	}
+	assertFiles(t, cfg, renewed)
+}
+
+func TestFileSinkBackupOnFailure(t *testing.T) {
+	dir, backupDir := t.TempDir(), t.TempDir()
+	cfg := testFileConfig(dir)
+	backups, err := backup.NewStore(&backup.Config{BackupPath: backupDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewFileSink(cfg, backups, false)
+	issue := newTestIssue(t, 10)
+
+	failRename(t, cfg.Key)
+	res, err := Ensure(context.Background(), s, Request{Domain: "example.com", RenewBefore: time.Hour}, func() (*Certificate, error) {
+		return issue.issued, nil
+	})
+	if err == nil {
+		t.Fatal("Ensure() succeeded although the key couldn't be moved into place")
+	}
+	if !res.WriteFailed || res.BackupPath == "" {
+		t.Fatalf("Ensure() = %+v, want a failed write with a backup", res)
+	}
+
+	b := backups.Load(res.BackupPath)
+	if b.Err != nil {
+		t.Fatalf("backup %s is unreadable: %v", res.BackupPath, b.Err)
+	}
+	if !bytes.Equal(b.Secret.Data["tls.crt"], issue.issued.CertPEM) || !bytes.Equal(b.Secret.Data["tls.key"], issue.issued.KeyPEM) {
+		t.Error("backup doesn't hold the issued certificate and key")
+	}
+}
@@ -0,0 +1,151 @@
+package sink
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Certificate is a result of a certificate issuance
+type Certificate struct {
+	// CertPEM is the leaf certificate followed by its issuer chain
+	CertPEM []byte
+	KeyPEM  []byte
+	// CertURL is the ACME URL of the issued certificate
+	CertURL string
+}
+
+// ErrIssueSkipped is returned by issue functions which don't order certificates in dry run mode
+var ErrIssueSkipped = errors.New("certificate issuance skipped in dry run")
+
+// Sink is a place where issued certificates are stored
+type Sink interface {
+	fmt.Stringer
+	// Load returns the stored leaf certificate, nil is returned if there is no usable certificate
+	Load(ctx context.Context) (*x509.Certificate, error)
+	// Store writes the issued certificate replacing the stored one
+	Store(ctx context.Context, issued *Certificate) error
+}
+
+// Completer is implemented by sinks which keep derived data next to a valid certificate and can restore it
+type Completer interface {
+	Complete(ctx context.Context) error
+}
+
+// FailureBackup is implemented by sinks which can keep the issued certificate elsewhere when Store fails,
+// the location of the backup or an empty string is returned
+type FailureBackup interface {
+	BackupOnFailure(ctx context.Context, issued *Certificate) string
+}
+
+// Hook is implemented by sinks which run an action after a new certificate is stored
+type Hook interface {
+	AfterStore(ctx context.Context) error
+}
+
+// Request describes when the stored certificate is replaced
+type Request struct {
+	Domain string
+	// Force reissues the certificate even if the current one is valid
+	Force bool
+	// RenewBefore is the remaining validity of the current certificate when it gets renewed
+	RenewBefore time.Duration
+}
+
+// Result describes what Ensure did, it's returned also together with an error
+type Result struct {
+	// Renewed is set if a new certificate was stored, in dry run mode if it would be stored
+	Renewed bool
+	// NotAfter is the expiry of the certificate which is stored after the check
+	NotAfter time.Time
+	// IssueFailed is set if a new certificate was needed but couldn't be issued
+	IssueFailed bool
+	// WriteFailed is set if the issued certificate couldn't be stored
+	WriteFailed bool
+	// BackupPath is the file the issued certificate was backed up to after a failed write
+	BackupPath string
+}
+
+// Ensure makes sure the sink holds a certificate which is valid for longer than the renewal window,
+// a new one is issued and stored otherwise
+func Ensure(ctx context.Context, s Sink, req Request, issue func() (*Certificate, error)) (*Result, error) {
+	log := logging.FromContext(ctx)
+	res := &Result{}
+
+	current, err := s.Load(ctx)
+	if err != nil {
+		return res, err
+	}
+	log.Infof("%s has a certificate: %v", s, current != nil)
+
+	if current != nil {
+		res.NotAfter = current.NotAfter
+	}
+
+	if !req.Force && current != nil && current.NotAfter.After(time.Now().Add(req.RenewBefore)) {
+		log.Infof("certificate in %s is valid until %s", s, current.NotAfter.UTC().Format(time.RFC3339))
+		if completer, ok := s.(Completer); ok {
+			return res, completer.Complete(ctx)
+		}
+
+		return res, nil
+	}
+
+	if req.Force {
+		log.Infof("reissue requested for %s, generating a new certificate", s)
+	} else {
+		log.Infof("certificate in %s is missing or not valid, generating a new one", s)
+	}
+
+	issued, err := issue()
+	if errors.Is(err, ErrIssueSkipped) {
+		log.Infof("dry run: would issue a new certificate for %s and write it to %s", req.Domain, s)
+		res.Renewed = true
+		return res, nil
+	}
+	if err != nil {
+		res.IssueFailed = true
+		return res, errors.Wrapf(err, "failed to generate cert for %s", req.Domain)
+	}
+
+	err = s.Store(ctx, issued)
+	if err != nil {
+		res.WriteFailed = true
+		if backup, ok := s.(FailureBackup); ok {
+			res.BackupPath = backup.BackupOnFailure(ctx, issued)
+		}
+		return res, err
+	}
+
+	res.Renewed = true
+	if cert, err := ParseLeaf(issued.CertPEM); err == nil {
+		res.NotAfter = cert.NotAfter
+	}
+
+	if hook, ok := s.(Hook); ok {
+		if err := hook.AfterStore(ctx); err != nil {
+			return res, errors.Wrapf(err, "certificate was written to %s", s)
+		}
+	}
+
+	return res, nil
+}
+
+// ParseLeaf decodes the first certificate of the PEM data
+func ParseLeaf(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificate")
+	}
+
+	return cert, nil
+}
@@ -0,0 +1,28 @@
+package tracing
+
+import (
+	"github.com/kelseyhightower/envconfig"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type Config struct {
+	// OTLPEndpoint is the host:port of the OTLP HTTP receiver, tracing is disabled if it's empty
+	OTLPEndpoint string `envconfig:"OTLP_ENDPOINT"`
+	// OTLPInsecure sends spans over plain HTTP
+	OTLPInsecure bool `envconfig:"OTLP_INSECURE" default:"false"`
+	// SampleRatio is the share of new traces which are recorded
+	SampleRatio float64 `envconfig:"SAMPLE_RATIO" default:"1"`
+}
+
+func LoadConfig() (cfg *Config, err error) {
+	cfg = new(Config)
+	err = envconfig.Process("tracing", cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load tracing config")
+	}
+
+	logrus.Infof("loaded tracing config: %+v", cfg)
+
+	return cfg, nil
+}
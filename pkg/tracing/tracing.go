@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"context"
+	"github.com/breathbath/certmanager/pkg/logging"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/breathbath/certmanager"
+
+	FieldTraceID = "trace_id"
+	FieldSpanID  = "span_id"
+)
+
+// Init sets up the global tracer provider exporting spans over OTLP, without a configured endpoint
+// spans are not recorded but the trace context is still propagated, the returned function flushes the spans
+func Init(ctx context.Context, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.OTLPEndpoint)}
+	if cfg.OTLPInsecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create OTLP trace exporter")
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+	))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create trace resource")
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	logrus.Infof("exporting traces of %s to %s", serviceName, cfg.OTLPEndpoint)
+
+	return provider.Shutdown, nil
+}
+
+// Start starts a span and adds its trace and span IDs to the logger in the returned context
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+
+	return WithLogFields(ctx), span
+}
+
+// WithLogFields adds the IDs of the current span to the logger in the context
+func WithLogFields(ctx context.Context) context.Context {
+	spanCtx := trace.SpanContextFromContext(ctx)
+	if !spanCtx.IsValid() {
+		return ctx
+	}
+
+	return logging.WithFields(ctx, logrus.Fields{
+		FieldTraceID: spanCtx.TraceID().String(),
+		FieldSpanID:  spanCtx.SpanID().String(),
+	})
+}
+
+// End records the error on the span if it's set and ends the span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Task returns the span attributes identifying a certificate task
+func Task(namespace, secret, domain string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("certmanager.namespace", namespace),
+		attribute.String("certmanager.secret", secret),
+		attribute.String("certmanager.domain", domain),
+	}
+}